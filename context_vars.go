@@ -0,0 +1,202 @@
+// context_vars
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContextVariable computes the value of a __name__ placeholder in stored
+// scripts from the interceptor context. Returning false leaves the
+// placeholder untouched.
+type ContextVariable func(context map[string]interface{}) (interface{}, bool)
+
+var contextVariables = map[string]ContextVariable{}
+var contextVariablesLock = &sync.RWMutex{}
+
+// RegisterContextVariable makes __name__ available to stored scripts. Values
+// are bound as statement params, slices expand to a list of params for use
+// in IN (...). Interceptors can also publish per request values by putting
+// them in the context_vars map of the context.
+func RegisterContextVariable(name string, variable ContextVariable) {
+	contextVariablesLock.Lock()
+	defer contextVariablesLock.Unlock()
+	contextVariables["__"+name+"__"] = variable
+}
+
+func contextString(key string) ContextVariable {
+	return func(context map[string]interface{}) (interface{}, bool) {
+		v, ok := context[key].(string)
+		return v, ok
+	}
+}
+
+func init() {
+	RegisterContextVariable("ip", contextString("client_ip"))
+	RegisterContextVariable("login_user_id", contextString("user_id"))
+	RegisterContextVariable("login_user_code", contextString("email"))
+	RegisterContextVariable("token_user_id", contextString("token_user_id"))
+	RegisterContextVariable("token_user_code", contextString("token_user_code"))
+	RegisterContextVariable("request_time", func(context map[string]interface{}) (interface{}, bool) {
+		if requestTime, ok := context["request_time"].(time.Time); ok {
+			return requestTime, true
+		}
+		return time.Now().UTC(), true
+	})
+}
+
+// buildContextVars evaluates the registered context variables and the
+// context_vars of the context, keyed by their placeholders.
+func buildContextVars(context map[string]interface{}) map[string]interface{} {
+	vars := map[string]interface{}{}
+	contextVariablesLock.RLock()
+	for placeholder, variable := range contextVariables {
+		if v, ok := variable(context); ok {
+			vars[placeholder] = v
+		}
+	}
+	contextVariablesLock.RUnlock()
+	if published, ok := context["context_vars"].(map[string]interface{}); ok {
+		for name, v := range published {
+			vars["__"+name+"__"] = v
+		}
+	}
+	return vars
+}
+
+// bindContextVars replaces the context placeholders of a statement with ?
+// and merges their values into args at the right positions.
+func bindContextVars(script string, args []interface{}, vars map[string]interface{}) (string, []interface{}) {
+	if len(vars) == 0 || !strings.Contains(script, "__") {
+		return script, args
+	}
+	return bindPlaceholders(script, args, func(s string, i int) (int, interface{}) {
+		if !strings.HasPrefix(s[i:], "__") || (i > 0 && isParamPart(s[i-1])) {
+			return 0, nil
+		}
+		k := strings.Index(s[i+2:], "__")
+		if k <= 0 {
+			return 0, nil
+		}
+		end := i + 2 + k + 2
+		if end < len(s) && isParamPart(s[end]) {
+			return 0, nil
+		}
+		v, ok := vars[s[i:end]]
+		if !ok {
+			return 0, nil
+		}
+		return end - i, v
+	})
+}
+
+// placeholderMatcher returns the length and value of the placeholder at i of
+// s, or 0 when there is none.
+type placeholderMatcher func(s string, i int) (int, interface{})
+
+// bindPlaceholders replaces the placeholders found by match with ? and merges
+// their values into args at the right positions. Slices expand to a list of
+// ?. A quoted literal consisting of just a placeholder is bound as a whole,
+// one with a placeholder in a longer text becomes CONCAT('text', ?, 'text'),
+// so values are never spliced into the script.
+func bindPlaceholders(script string, args []interface{}, match placeholderMatcher) (string, []interface{}) {
+	var buf bytes.Buffer
+	ret := make([]interface{}, 0, len(args))
+	argIndex := 0
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			ret = appendQuoted(&buf, ret, script[i:j], match)
+			i = j
+			continue
+		}
+		if script[i] == '?' {
+			if argIndex < len(args) {
+				ret = append(ret, args[argIndex])
+				argIndex++
+			}
+			buf.WriteByte('?')
+			i++
+			continue
+		}
+		if n, v := match(script, i); n > 0 {
+			ret = appendBoundValue(&buf, ret, v)
+			i += n
+			continue
+		}
+		buf.WriteByte(script[i])
+		i++
+	}
+	if argIndex < len(args) {
+		ret = append(ret, args[argIndex:]...)
+	}
+	return buf.String(), ret
+}
+
+func appendQuoted(buf *bytes.Buffer, args []interface{}, quoted string, match placeholderMatcher) []interface{} {
+	c := quoted[0]
+	if (c != '\'' && c != '"') || len(quoted) <= 2 || quoted[len(quoted)-1] != c {
+		buf.WriteString(quoted)
+		return args
+	}
+	text := quoted[1 : len(quoted)-1]
+	if n, v := match(text, 0); n == len(text) {
+		return appendBoundValue(buf, args, v)
+	}
+	parts := []string{}
+	values := []interface{}{}
+	start := 0
+	for i := 0; i < len(text); {
+		if text[i] == '\\' || (text[i] == c && i+1 < len(text) && text[i+1] == c) {
+			i += 2
+			continue
+		}
+		if n, v := match(text, i); n > 0 && !isListValue(v) {
+			if i > start {
+				parts = append(parts, string(c)+text[start:i]+string(c))
+			}
+			parts = append(parts, "?")
+			values = append(values, v)
+			i += n
+			start = i
+			continue
+		}
+		i++
+	}
+	if len(values) == 0 {
+		buf.WriteString(quoted)
+		return args
+	}
+	if start < len(text) {
+		parts = append(parts, string(c)+text[start:]+string(c))
+	}
+	buf.WriteString("CONCAT(" + strings.Join(parts, ",") + ")")
+	return append(args, values...)
+}
+
+func isListValue(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	return v != nil && rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8
+}
+
+func appendBoundValue(buf *bytes.Buffer, args []interface{}, v interface{}) []interface{} {
+	if !isListValue(v) {
+		buf.WriteByte('?')
+		return append(args, v)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Len() == 0 {
+		buf.WriteString("NULL")
+		return args
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('?')
+		args = append(args, rv.Index(i).Interface())
+	}
+	return args
+}
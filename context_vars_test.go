@@ -0,0 +1,60 @@
+// context_vars_test
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBindContextVars(t *testing.T) {
+	at := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	vars := map[string]interface{}{
+		"__token_user_id__": "u1",
+		"__request_time__":  at,
+		"__roles__":         []string{"a", "b"},
+	}
+
+	t.Run("binds placeholders between positional params", func(t *testing.T) {
+		script, args := bindContextVars("SELECT * FROM t WHERE A=? AND U=__token_user_id__ AND B=?", []interface{}{1, 2}, vars)
+		if script != "SELECT * FROM t WHERE A=? AND U=? AND B=?" {
+			t.Fatalf("got %q", script)
+		}
+		if !reflect.DeepEqual(args, []interface{}{1, "u1", 2}) {
+			t.Fatalf("got %v", args)
+		}
+	})
+
+	t.Run("expands slices", func(t *testing.T) {
+		script, args := bindContextVars("SELECT * FROM t WHERE ROLE IN (__roles__)", nil, vars)
+		if script != "SELECT * FROM t WHERE ROLE IN (?,?)" || len(args) != 2 {
+			t.Fatalf("got %q %v", script, args)
+		}
+	})
+
+	t.Run("binds a literal made of a placeholder", func(t *testing.T) {
+		script, args := bindContextVars("SELECT * FROM t WHERE U='__token_user_id__'", nil, vars)
+		if script != "SELECT * FROM t WHERE U=?" || !reflect.DeepEqual(args, []interface{}{"u1"}) {
+			t.Fatalf("got %q %v", script, args)
+		}
+	})
+
+	t.Run("binds placeholders inside longer literals through CONCAT", func(t *testing.T) {
+		script, args := bindContextVars(`SELECT 'by __token_user_id__ at __request_time__', 'it''s \' __x__'`, nil, vars)
+		expected := `SELECT CONCAT('by ',?,' at ',?), 'it''s \' __x__'`
+		if script != expected {
+			t.Fatalf("got %q, expected %q", script, expected)
+		}
+		if len(args) != 2 || args[0] != "u1" || args[1] != at {
+			t.Fatalf("got %v", args)
+		}
+	})
+
+	t.Run("matches whole words only", func(t *testing.T) {
+		in := "SELECT x__token_user_id__, __token_user_id__y, `__token_user_id__` FROM t -- __token_user_id__"
+		script, args := bindContextVars(in, nil, vars)
+		if script != in || len(args) != 0 {
+			t.Fatalf("got %q %v", script, args)
+		}
+	})
+}
@@ -3,12 +3,10 @@ package main
 import (
 	"fmt"
 	"math/rand"
-	"strings"
 	"time"
 
 	"github.com/elgs/gorest2"
 	"github.com/elgs/gosqljson"
-	"github.com/satori/go.uuid"
 )
 
 func init() {
@@ -90,97 +88,46 @@ func init() {
 				if !pushNode {
 					return
 				}
-				statusId := uuid.NewV4().String()
 				db, err := dbo.GetConn()
 				if err != nil {
 					fmt.Println(err)
 					return
 				}
-				rowAffected, err := gosqljson.ExecDb(db, `UPDATE push_notification SET STATUS=? WHERE STATUS=0 ORDER BY CREATE_TIME`, statusId)
-				if err != nil {
-					fmt.Println(err)
+				deliverPushNotifications(db)
+			}
+		},
+	})
+
+	gorest2.RegisterJob("prune_push_attempts", &gorest2.Job{
+		Cron: "0 15 * * * *",
+		MakeAction: func(dbo gorest2.DataOperator) func() {
+			return func() {
+				if !pushNode {
 					return
 				}
-				if rowAffected == 0 {
+				db, err := dbo.GetConn()
+				if err != nil {
+					fmt.Println(err)
 					return
 				}
-				data, err := gosqljson.QueryDbToMap(db, "", `SELECT * FROM push_notification WHERE STATUS=?`, statusId)
+				err = prunePushAttempts(db)
 				if err != nil {
 					fmt.Println(err)
-					return
 				}
-				dataLen := len(data)
-				good := make([]interface{}, 0, dataLen/2+1)
-				bad := make([]interface{}, 0, dataLen/2+1)
-
-				c := make(chan int, dataLen)
-				for _, v := range data {
-					go func(v map[string]string) {
-						testUrl := strings.ToLower(v["url"])
-						if strings.Contains(testUrl, "://localhost") ||
-							strings.Contains(testUrl, "netdata.io") ||
-							strings.Contains(testUrl, "://127.0.") {
-							bad = append(bad, v["ID"])
-							c <- 1
-							return
-						}
-						res, statusCode, err := httpRequest(v["URL"], v["METHOD"], v["DATA"], -1)
-						if err == nil && statusCode == 200 {
-							good = append(good, v["ID"])
+			}
+		},
+	})
 
-							clientData := string(res)
-							callback := v["CALLBACK"]
-							if strings.TrimSpace(callback) != "" {
-								// return a array of array as parameters for callback
-								appId := v["PROJECT_ID"]
-								query, err := loadQuery(appId, callback)
-								if err != nil {
-									fmt.Println(err)
-									return
-								}
-								scripts := query["script"]
-								replaceContext := map[string]string{
-									"__token_user_id__":   v["CREATOR_ID"],
-									"__token_user_code__": v["CREATOR_CODE"],
-									"__login_user_id__":   v["CREATOR_ID"],
-									"__login_user_code__": v["CREATOR_CODE"],
-								}
-								queryParams, params, err := buildParams(clientData)
-								//		fmt.Println(queryParams, params)
-								if err != nil {
-									fmt.Println(err)
-									return
-								}
-								appDbo := gorest2.GetDbo(appId)
-								if appDbo == nil {
-									fmt.Println(err)
-									return
-								}
-								appDb, err := appDbo.GetConn()
-								if appDbo == nil {
-									fmt.Println(err)
-									return
-								}
-								_, err = batchExecuteTx(nil, appDb, &scripts, queryParams, params, replaceContext)
-								if err != nil {
-									fmt.Println(err)
-									return
-								}
-							}
-						} else {
-							bad = append(bad, v["ID"])
-						}
-						c <- 1
-					}(v)
-				}
-				for i := 0; i < dataLen; i++ {
-					<-c
-				}
-				if len(good) > 0 {
-					gosqljson.ExecDb(db, fmt.Sprintf(`UPDATE push_notification SET STATUS=-1, UPDATE_TIME=CONVERT_TZ(NOW(),'System','+0:0') WHERE ID IN(%v)`, GeneratePlaceholders(len(good))), good...)
+	gorest2.RegisterJob("sweep_outboxes", &gorest2.Job{
+		Cron: "30 * * * * *",
+		MakeAction: func(dbo gorest2.DataOperator) func() {
+			return func() {
+				if !pushNode {
+					return
 				}
-				if len(bad) > 0 {
-					gosqljson.ExecDb(db, fmt.Sprintf(`UPDATE push_notification SET STATUS=1, UPDATE_TIME=CONVERT_TZ(NOW(),'System','+0:0') WHERE ID IN(%v)`, GeneratePlaceholders(len(bad))), bad...)
+				err := sweepOutboxes()
+				if err != nil {
+					fmt.Println(err)
 				}
 			}
 		},
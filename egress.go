@@ -0,0 +1,272 @@
+// egress
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// egressPolicy decides which hosts remote interceptors and push
+// notifications may connect to. Hosts are checked when the connection is
+// made, after resolution, and the checked address is the one dialed, so
+// redirects and DNS rebinding cannot reach around it. In order:
+//
+//   - a host or address on the deny list is rejected
+//   - a host or address on the allow list is accepted
+//   - a host resolving to any private, loopback, link-local, metadata or
+//     otherwise non public address is rejected, as is any address of the
+//     NAT64, 6to4 and Teredo ranges, which can embed such addresses
+//
+// The lists are read from egress_allow and egress_deny of the config, both
+// arrays of host names, *.domain wildcards, addresses and CIDR ranges.
+type egressPolicy struct {
+	Allow []*egressRule
+	Deny  []*egressRule
+}
+
+type egressRule struct {
+	Host string
+	Net  *net.IPNet
+}
+
+type egressError struct {
+	msg string
+}
+
+func (this *egressError) Error() string {
+	return this.msg
+}
+
+var defaultEgressDeny = []interface{}{"netdata.io", "*.netdata.io"}
+
+var egress = &egressPolicy{Deny: mustParseEgressRules(defaultEgressDeny)}
+
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64", "2001::/32",
+	"2001:db8::/32", "2002::/16", "fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	ret := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret
+}
+
+func mustParseEgressRules(v interface{}) []*egressRule {
+	rules, err := parseEgressRules(v)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func parseEgressRules(v interface{}) ([]*egressRule, error) {
+	if v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Invalid egress rules: ", v))
+	}
+	rules := []*egressRule{}
+	for _, item := range items {
+		s, ok := item.(string)
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !ok || s == "" {
+			return nil, errors.New(fmt.Sprint("Invalid egress rule: ", item))
+		}
+		if strings.Contains(s, "/") {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, errors.New(fmt.Sprint("Invalid egress rule: ", item))
+			}
+			rules = append(rules, &egressRule{Net: ipNet})
+		} else if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			rules = append(rules, &egressRule{Net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+		} else {
+			rules = append(rules, &egressRule{Host: s})
+		}
+	}
+	return rules, nil
+}
+
+// parseEgressPolicy reads the policy from the config. The default deny list
+// applies when egress_deny is not set.
+func parseEgressPolicy(allow, deny interface{}) (*egressPolicy, error) {
+	if deny == nil {
+		deny = defaultEgressDeny
+	}
+	policy := &egressPolicy{}
+	var err error
+	policy.Allow, err = parseEgressRules(allow)
+	if err != nil {
+		return nil, err
+	}
+	policy.Deny, err = parseEgressRules(deny)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (this *egressRule) matchHost(host string) bool {
+	if this.Host == "" {
+		return false
+	}
+	if strings.HasPrefix(this.Host, "*.") {
+		return strings.HasSuffix(host, this.Host[1:])
+	}
+	return host == this.Host
+}
+
+func (this *egressRule) matchIP(ip net.IP) bool {
+	return this.Net != nil && this.Net.Contains(ip)
+}
+
+func matchEgressRules(rules []*egressRule, host string, ip net.IP) bool {
+	for _, rule := range rules {
+		if (host != "" && rule.matchHost(host)) || (ip != nil && rule.matchIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		// includes IPv4 mapped IPv6 addresses
+		ip = ip4
+	}
+	for _, ipNet := range blockedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHost rejects a host name on the deny list, and tells whether it is
+// on the allow list, in which case its addresses are not checked further.
+func (this *egressPolicy) checkHost(host string) (bool, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchEgressRules(this.Deny, host, nil) {
+		return false, &egressError{"Host not allowed: " + host}
+	}
+	return matchEgressRules(this.Allow, host, nil), nil
+}
+
+func (this *egressPolicy) checkIP(ip net.IP, hostAllowed bool) error {
+	if matchEgressRules(this.Deny, "", ip) {
+		return &egressError{"Address not allowed: " + ip.String()}
+	}
+	if hostAllowed || matchEgressRules(this.Allow, "", ip) {
+		return nil
+	}
+	if !isPublicIP(ip) {
+		return &egressError{"Address not allowed: " + ip.String()}
+	}
+	return nil
+}
+
+// checkURL is a quick check of a url before anything is sent. The real
+// check happens when connecting.
+func (this *egressPolicy) checkURL(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &egressError{"Only http and https urls are allowed."}
+	}
+	host := u.Hostname()
+	if host == "" {
+		return &egressError{"Url has no host."}
+	}
+	allowed, err := this.checkHost(host)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return this.checkIP(ip, allowed)
+	}
+	return nil
+}
+
+// dial resolves the host of addr, checks all of its addresses and connects
+// to the first one that answers.
+func (this *egressPolicy) dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := this.checkHost(host)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("No address for host: " + host)
+	}
+	// any bad address fails the host, so the answer of a later lookup
+	// cannot matter
+	for _, ip := range ips {
+		err = this.checkIP(ip, allowed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (this *egressPolicy) dialer(timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		return this.dial(network, addr, timeout)
+	}
+}
+
+// isEgressDenied tells whether a request failed because the egress policy
+// refused its host.
+func isEgressDenied(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	_, ok := err.(*egressError)
+	return ok
+}
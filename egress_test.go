@@ -0,0 +1,155 @@
+// egress_test
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEgressCheckIP(t *testing.T) {
+	policy, err := parseEgressPolicy([]interface{}{"10.1.2.0/24", "fd00::1"}, []interface{}{"203.0.113.7", "8.8.4.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		ip          string
+		hostAllowed bool
+		allowed     bool
+	}{
+		{"93.184.216.34", false, true},
+		{"2606:2800:220:1:248:1893:25c8:1946", false, true},
+		{"127.0.0.1", false, false},
+		{"10.0.0.1", false, false},
+		{"172.16.5.4", false, false},
+		{"192.168.1.1", false, false},
+		{"169.254.169.254", false, false},
+		{"100.64.0.1", false, false},
+		{"0.0.0.0", false, false},
+		{"224.0.0.1", false, false},
+		{"::1", false, false},
+		{"::", false, false},
+		{"::ffff:127.0.0.1", false, false},
+		{"::ffff:169.254.169.254", false, false},
+		{"fe80::1", false, false},
+		{"fc00::1", false, false},
+		{"64:ff9b::a9fe:a9fe", false, false},
+		{"64:ff9b:1::a00:1", false, false},
+		{"2002:a9fe:a9fe::1", false, false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false, false},
+		{"10.1.2.3", false, true},
+		{"10.1.3.3", false, false},
+		{"fd00::1", false, true},
+		{"192.168.1.1", true, true},
+		{"8.8.4.4", false, false},
+		{"8.8.4.4", true, false},
+		{"203.0.113.7", true, false},
+	}
+	for _, c := range cases {
+		err := policy.checkIP(net.ParseIP(c.ip), c.hostAllowed)
+		if c.allowed && err != nil {
+			t.Errorf("checkIP(%s, %v) unexpected error: %v", c.ip, c.hostAllowed, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("checkIP(%s, %v) expected to be denied", c.ip, c.hostAllowed)
+		}
+	}
+}
+
+func TestEgressCheckURL(t *testing.T) {
+	policy, err := parseEgressPolicy([]interface{}{"*.internal.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://example.com:8080/hook", true},
+		{"https://api.internal.example.com/hook", true},
+		{"https://netdata.io/hook", false},
+		{"https://api.netdata.io/hook", false},
+		{"https://API.NETDATA.IO./hook", false},
+		{"ftp://example.com/hook", false},
+		{"file:///etc/passwd", false},
+		{"https:///hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]:80/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://93.184.216.34/hook", true},
+	}
+	for _, c := range cases {
+		err := policy.checkURL(c.url)
+		if c.allowed && err != nil {
+			t.Errorf("checkURL(%s) unexpected error: %v", c.url, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("checkURL(%s) expected to be denied", c.url)
+		}
+	}
+}
+
+func TestParseEgressPolicy(t *testing.T) {
+	var cases = []struct {
+		allow interface{}
+		deny  interface{}
+		err   bool
+	}{
+		{nil, nil, false},
+		{[]interface{}{"example.com", "*.example.com", "10.0.0.0/8", "::1"}, []interface{}{}, false},
+		{"example.com", nil, true},
+		{[]interface{}{""}, nil, true},
+		{[]interface{}{1}, nil, true},
+		{nil, []interface{}{"10.0.0.0/33"}, true},
+	}
+	for i, c := range cases {
+		_, err := parseEgressPolicy(c.allow, c.deny)
+		if c.err && err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+		if !c.err && err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestEgressDial(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	byName := "http://localhost:" + port
+
+	defaultEgress := egress
+	defer func() { egress = defaultEgress }()
+
+	egress = &egressPolicy{}
+	for _, url := range []string{server.URL, byName} {
+		_, _, err := httpRequest(url, "GET", "", -1, nil)
+		if !isEgressDenied(err) {
+			t.Errorf("%s got %v, expected it to be denied", url, err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Fatalf("a denied request reached the server")
+	}
+
+	egress, _ = parseEgressPolicy([]interface{}{"127.0.0.1", "::1"}, nil)
+	res, statusCode, err := httpRequest(byName, "GET", "", -1, nil)
+	if err != nil || statusCode != 200 || string(res) != "ok" {
+		t.Fatalf("got %q %d %v", res, statusCode, err)
+	}
+
+	egress, _ = parseEgressPolicy([]interface{}{"127.0.0.1", "::1"}, []interface{}{"localhost"})
+	_, _, err = httpRequest(byName, "GET", "", -1, nil)
+	if !isEgressDenied(err) {
+		t.Errorf("got %v, expected the denied host to win over its allowed address", err)
+	}
+}
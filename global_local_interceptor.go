@@ -91,11 +91,12 @@ func (this *GlobalLocalInterceptor) checkAgainstBeforeLocalInterceptor(tx *sql.T
 			return false, err
 		}
 		scripts := query["script"]
-		replaceContext := buildReplaceContext(context)
-		_, err = batchExecuteTx(tx, db, &scripts, queryParams, params, replaceContext)
+		contextVars := buildContextVars(context)
+		_, err = batchExecuteTx(tx, db, query, &scripts, queryParams, params, contextVars)
 		if err != nil {
 			return false, err
 		}
+		recordQueryCacheWrites(tx, context, scripts)
 	}
 	return true, nil
 }
@@ -105,6 +106,9 @@ func (this *GlobalLocalInterceptor) executeAfterLocalInterceptor(tx *sql.Tx, db
 }
 
 func (this *GlobalLocalInterceptor) commonBefore(tx *sql.Tx, db *sql.DB, resourceId string, context map[string]interface{}, action string, data interface{}, params [][]interface{}, queryParams []string) (bool, error) {
+	if isDryRun(context) {
+		return true, nil
+	}
 	rts := strings.Split(strings.Replace(resourceId, "`", "", -1), ".")
 	resourceId = rts[len(rts)-1]
 	appId := context["app_id"].(string)
@@ -146,6 +150,9 @@ func (this *GlobalLocalInterceptor) commonBefore(tx *sql.Tx, db *sql.DB, resourc
 }
 
 func (this *GlobalLocalInterceptor) commonAfter(tx *sql.Tx, db *sql.DB, resourceId string, context map[string]interface{}, action string, data interface{}, params [][]interface{}, queryParams []string) error {
+	if isDryRun(context) {
+		return nil
+	}
 	rts := strings.Split(strings.Replace(resourceId, "`", "", -1), ".")
 	resourceId = rts[len(rts)-1]
 	appId := context["app_id"].(string)
@@ -276,6 +283,12 @@ func (this *GlobalLocalInterceptor) AfterListArray(resourceId string, db *sql.DB
 func (this *GlobalLocalInterceptor) BeforeQueryMap(resourceId string, script string, params *[]interface{}, db *sql.DB, context map[string]interface{}) (bool, error) {
 	return this.commonBefore(nil, db, resourceId, context, "query_map", map[string]interface{}{"params": *params}, nil, nil)
 }
+func (this *GlobalLocalInterceptor) HasAfterQuery(resourceId string, context map[string]interface{}) bool {
+	rts := strings.Split(strings.Replace(resourceId, "`", "", -1), ".")
+	appId, _ := context["app_id"].(string)
+	key := strings.Join([]string{"li", appId, rts[len(rts)-1], "after", "query_map"}, ":")
+	return gorest2.RedisLocal.Exists(key).Val()
+}
 func (this *GlobalLocalInterceptor) AfterQueryMap(resourceId string, script string, params *[]interface{}, db *sql.DB, context map[string]interface{}, data *[]map[string]string) error {
 	return this.commonAfter(nil, db, resourceId, context, "query_map", *data, nil, nil)
 }
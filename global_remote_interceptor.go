@@ -5,13 +5,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/elgs/gorest2"
 	"github.com/elgs/gosqljson"
 	"github.com/elgs/jsonql"
-	"github.com/satori/go.uuid"
 )
 
 func init() {
@@ -24,10 +25,10 @@ type GlobalRemoteInterceptor struct {
 	Id string
 }
 
+// Remote interceptors are cached in a redis hash per event,
+// ri:<project>:<target>:<type>:<action>, that maps the id of every enabled
+// interceptor of the event to its fields as JSON.
 func loadAllRemoteInterceptor() error {
-	pipe := gorest2.RedisMaster.Pipeline()
-	defer pipe.Close()
-
 	// load all remote interceptor definitions into RemoteInterceptorRegistry
 	defaultDbo := gorest2.GetDbo("default")
 	defaultDb, err := defaultDbo.GetConn()
@@ -38,71 +39,220 @@ func loadAllRemoteInterceptor() error {
 	if err != nil {
 		return err
 	}
+	entries := map[string]map[string]string{}
 	for _, riMap := range riData {
-		projectId := riMap["PROJECT_ID"]
-		target := riMap["TARGET"]
-		theType := riMap["TYPE"]
-		actionType := riMap["ACTION_TYPE"]
-		criteria := riMap["CRITERIA"]
-		method := riMap["METHOD"]
-		url := riMap["URL"]
-		callback := riMap["CALLBACK"]
-		key := strings.Join([]string{"ri", projectId, target, theType, actionType}, ":")
-		pipe.HMSet(key, "method", method, "url", url, "criteria", criteria, "callback", callback)
+		if !riEnabled(riMap["ENABLED"]) {
+			continue
+		}
+		err = ensureRiSecret(defaultDb, riMap)
+		if err != nil {
+			return err
+		}
+		key, value, err := remoteInterceptorEntry(riMap)
+		if err != nil {
+			return err
+		}
+		if entries[key] == nil {
+			entries[key] = map[string]string{}
+		}
+		entries[key][riMap["ID"]] = value
+	}
+
+	pipe := gorest2.RedisMaster.Pipeline()
+	defer pipe.Close()
+	// drop what is gone without ever emptying a hash still in use
+	for _, key := range gorest2.RedisMaster.Keys("ri:*").Val() {
+		stale := []string{}
+		for field := range gorest2.RedisMaster.HGetAllMap(key).Val() {
+			if _, ok := entries[key][field]; !ok {
+				stale = append(stale, field)
+			}
+		}
+		if len(entries[key]) == 0 {
+			pipe.Del(key)
+		} else if len(stale) > 0 {
+			pipe.HDel(key, stale...)
+		}
+	}
+	for key, fields := range entries {
+		for id, value := range fields {
+			pipe.HSet(key, id, value)
+		}
 	}
 	_, err = pipe.Exec()
 	return err
 }
 
-func loadRemoteInterceptor(projectId, target, theType, actionType string) error {
-	// load specific remote interceptor definitions into RemoteInterceptorRegistry
+// loadRemoteInterceptor caches the remote interceptor with the given id,
+// unless it is disabled.
+func loadRemoteInterceptor(id string) error {
 	defaultDbo := gorest2.GetDbo("default")
 	defaultDb, err := defaultDbo.GetConn()
 	if err != nil {
 		return err
 	}
 	riData, err := gosqljson.QueryDbToMap(defaultDb,
-		"upper", "SELECT * FROM remote_interceptor WHERE PROJECT_ID=? AND TARGET=? AND TYPE=? AND ACTION_TYPE=?",
-		projectId, target, theType, actionType)
+		"upper", "SELECT * FROM remote_interceptor WHERE ID=?", id)
 	if err != nil {
 		return err
 	}
-	if riData != nil && len(riData) == 1 {
-		riMap := riData[0]
-		projectId := riMap["PROJECT_ID"]
-		target := riMap["TARGET"]
-		method := riMap["METHOD"]
-		url := riMap["URL"]
-		theType := riMap["TYPE"]
-		actionType := riMap["ACTION_TYPE"]
-		criteria := riMap["CRITERIA"]
-		callback := riMap["CALLBACK"]
-		key := strings.Join([]string{"ri", projectId, target, theType, actionType}, ":")
-		gorest2.RedisMaster.HMSet(key, "method", method, "url", url, "criteria", criteria, "callback", callback)
+	if len(riData) == 1 && riEnabled(riData[0]["ENABLED"]) {
+		err = ensureRiSecret(defaultDb, riData[0])
+		if err != nil {
+			return err
+		}
+		key, value, err := remoteInterceptorEntry(riData[0])
+		if err != nil {
+			return err
+		}
+		return gorest2.RedisMaster.HSet(key, id, value).Err()
 	}
 	return nil
 }
 
-func unloadRemoteInterceptor(projectId, target, theType, actionType string) error {
+// remoteInterceptorEntry returns the cache key of a remote interceptor row
+// and the JSON of the fields it is cached with.
+func remoteInterceptorEntry(riMap map[string]string) (string, string, error) {
+	key := strings.Join([]string{"ri", riMap["PROJECT_ID"], riMap["TARGET"], riMap["TYPE"], riMap["ACTION_TYPE"]}, ":")
+	ri := map[string]string{
+		"id":                 riMap["ID"],
+		"priority":           riMap["PRIORITY"],
+		"method":             riMap["METHOD"],
+		"url":                riMap["URL"],
+		"criteria":           riMap["CRITERIA"],
+		"callback":           riMap["CALLBACK"],
+		"secret":             riMap["SECRET"],
+		"max_attempts":       riMap["MAX_ATTEMPTS"],
+		"backoff":            riMap["BACKOFF"],
+		"retry_status_codes": riMap["RETRY_STATUS_CODES"],
+		"failure_threshold":  riMap["FAILURE_THRESHOLD"],
+		"cool_down":          riMap["COOL_DOWN"],
+		"fail_policy":        riMap["FAIL_POLICY"],
+	}
+	for _, field := range riOptionFields {
+		ri[strings.ToLower(field)] = riMap[field]
+	}
+	jsonData, err := json.Marshal(ri)
+	if err != nil {
+		return "", "", err
+	}
+	return key, string(jsonData), nil
+}
+
+func unloadRemoteInterceptor(projectId, target, theType, actionType, id string) error {
 	// unload specific remote interceptor definitions into RemoteInterceptorRegistry
 	key := strings.Join([]string{"ri", projectId, target, theType, actionType}, ":")
-	err := gorest2.RedisMaster.Del(key).Err()
+	err := gorest2.RedisMaster.HDel(key, id).Err()
 	return err
 }
 
-func (this *GlobalRemoteInterceptor) checkAgainstBeforeRemoteInterceptor(tx *sql.Tx, db *sql.DB, context map[string]interface{}, data string, appId string, resourceId string, action string, ri map[string]string) (bool, error) {
+// remoteInterceptors returns the remote interceptors of an event in the
+// order of their PRIORITY, lowest first, then their id.
+func remoteInterceptors(appId, resourceId, theType, action string) []map[string]string {
+	key := strings.Join([]string{"ri", appId, resourceId, theType, action}, ":")
+	ret := []map[string]string{}
+	for id, value := range gorest2.RedisLocal.HGetAllMap(key).Val() {
+		ri := map[string]string{}
+		err := json.Unmarshal([]byte(value), &ri)
+		if err != nil {
+			fmt.Println(key, id, err)
+			continue
+		}
+		ret = append(ret, ri)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		pi, _ := strconv.Atoi(ret[i]["priority"])
+		pj, _ := strconv.Atoi(ret[j]["priority"])
+		if pi != pj {
+			return pi < pj
+		}
+		return ret[i]["id"] < ret[j]["id"]
+	})
+	return ret
+}
+
+func riEnabled(enabled string) bool {
+	switch strings.ToLower(strings.TrimSpace(enabled)) {
+	case "0", "false":
+		return false
+	}
+	return true
+}
+
+// matchCriteria runs the jsonql criteria of a remote interceptor on data.
+// It tells whether the interceptor applies, and what to send it.
+func matchCriteria(ri map[string]string, data interface{}) (interface{}, bool, error) {
+	criteria := ri["criteria"]
+	if len(strings.TrimSpace(criteria)) == 0 {
+		return data, true, nil
+	}
+	parser := jsonql.NewQuery(data)
+	criteriaResult, err := parser.Query(criteria)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch v := criteriaResult.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, false, nil
+		}
+	case map[string]interface{}:
+		if v == nil {
+			return nil, false, nil
+		}
+	default:
+		return nil, false, nil
+	}
+	return criteriaResult, true, nil
+}
+
+func (this *GlobalRemoteInterceptor) checkAgainstBeforeRemoteInterceptor(tx *sql.Tx, db *sql.DB, context map[string]interface{}, data string, appId string, resourceId string, action string, ri map[string]string, target *riPatchTarget) (bool, error) {
 	//	res, status, err := httpRequest(ri["url"], ri["method"], data, int64(len([]byte(data))))
 	//	fmt.Println("data:", data)
-	res, status, err := httpRequest(ri["url"], ri["method"], data, -1)
+	breaker, err := parseRiBreaker(ri["id"], ri["failure_threshold"], ri["cool_down"], ri["fail_policy"])
+	if err != nil {
+		return false, err
+	}
+	opts, err := parseRiOptions(ri, newDeliveryId(), data)
 	if err != nil {
 		return false, err
 	}
+	if breaker.isOpen(opts.ConnectTimeout + opts.ReadTimeout) {
+		return breaker.failed(errRiUnavailable)
+	}
+	res, status, err := httpRequest(ri["url"], ri["method"], data, -1, opts)
+	if err != nil {
+		if isEgressDenied(err) {
+			breaker.release()
+			return false, err
+		}
+		breaker.failure()
+		return breaker.failed(err)
+	}
+	if status >= 500 {
+		breaker.failure()
+		return breaker.failed(errors.New("Client failed."))
+	}
+	breaker.success()
 	if status != 200 {
 		return false, errors.New("Client rejected.")
 	}
 	callback := ri["callback"]
 	clientData := string(res)
 
+	patch, err := parseRiPatch(clientData)
+	if err != nil {
+		return false, err
+	}
+	if patch != nil {
+		err = patch.validate(target)
+		if err != nil {
+			return false, err
+		}
+		patch.apply(target)
+	}
+
 	if strings.TrimSpace(callback) != "" {
 		// return a array of array as parameters for callback
 		query, err := loadQuery(appId, callback)
@@ -110,119 +260,113 @@ func (this *GlobalRemoteInterceptor) checkAgainstBeforeRemoteInterceptor(tx *sql
 			return false, err
 		}
 		scripts := query["script"]
-		replaceContext := buildReplaceContext(context)
+		contextVars := buildContextVars(context)
 		queryParams, params, err := buildParams(clientData)
 		//		fmt.Println(queryParams, params)
 		if err != nil {
 			return false, err
 		}
-		_, err = batchExecuteTx(tx, db, &scripts, queryParams, params, replaceContext)
+		_, err = batchExecuteTx(tx, db, query, &scripts, queryParams, params, contextVars)
 		if err != nil {
 			return false, err
 		}
+		recordQueryCacheWrites(tx, context, scripts)
 	}
 	return true, nil
 
 }
 
-func (this *GlobalRemoteInterceptor) executeAfterRemoteInterceptor(data string, appId string, resourceId string, action string, ri map[string]string, context map[string]interface{}) error {
-	dataId := strings.Replace(uuid.NewV4().String(), "-", "", -1)
-	insert := `INSERT INTO push_notification(ID,PROJECT_ID,TARGET,METHOD,URL,TYPE,ACTION_TYPE,STATUS,DATA,CALLBACK,
-	CREATOR_ID,CREATOR_CODE,CREATE_TIME,UPDATER_ID,UPDATER_CODE,UPDATE_TIME) 
-	VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
-	now := time.Now().UTC()
-	userId := context["user_id"]
-	userCode := context["email"]
-
-	params := []interface{}{dataId, appId, resourceId, ri["method"], ri["url"], "after", action, "0", data, ri["callback"],
-		userId, userCode, now, userId, userCode, now}
-	defaultDbo := gorest2.GetDbo("default")
-	defaultDb, err := defaultDbo.GetConn()
+// executeAfterRemoteInterceptor queues a push notification through the
+// outbox of the project.
+func (this *GlobalRemoteInterceptor) executeAfterRemoteInterceptor(tx *sql.Tx, db *sql.DB, data string, appId string, resourceId string, action string, ri map[string]string, context map[string]interface{}) error {
+	userId, _ := context["user_id"].(string)
+	userCode, _ := context["email"].(string)
+	event := &outboxEvent{
+		RiId:        ri["id"],
+		Target:      resourceId,
+		Action:      action,
+		Data:        data,
+		CreatorId:   userId,
+		CreatorCode: userCode,
+	}
+	if tx != nil {
+		id, err := writeOutbox(tx, nil, event)
+		if err != nil {
+			return err
+		}
+		outbox, _ := context["outbox"].([]string)
+		context["outbox"] = append(outbox, id)
+		return nil
+	}
+	if db == nil {
+		var err error
+		db, err = projectConn(appId)
+		if err != nil {
+			return err
+		}
+	}
+	id, err := writeOutbox(nil, db, event)
 	if err != nil {
 		return err
 	}
-	_, err = gosqljson.ExecDb(defaultDb, insert, params...)
-	return err
+	return relayOutbox(appId, []string{id})
 }
 
-func (this *GlobalRemoteInterceptor) commonBefore(tx *sql.Tx, db *sql.DB, resourceId string, context map[string]interface{}, action string, data interface{}) (bool, error) {
+// commonBefore calls the before interceptors of an event one after the
+// other, and stops at the first that rejects it. target is what their
+// patches apply to, nil when the action cannot be patched. A dry run calls
+// none of them, it must not reach the outside.
+func (this *GlobalRemoteInterceptor) commonBefore(tx *sql.Tx, db *sql.DB, resourceId string, context map[string]interface{}, action string, data interface{}, target *riPatchTarget) (bool, error) {
+	if isDryRun(context) {
+		return true, nil
+	}
 	rts := strings.Split(strings.Replace(resourceId, "`", "", -1), ".")
 	resourceId = rts[len(rts)-1]
 	appId := context["app_id"].(string)
-	key := strings.Join([]string{"ri", appId, resourceId, "before", action}, ":")
-	ri := gorest2.RedisLocal.HGetAllMap(key).Val()
-	if len(ri) == 0 {
-		return true, nil
-	}
-
-	criteria := ri["criteria"]
-	if len(strings.TrimSpace(criteria)) > 0 {
-		parser := jsonql.NewQuery(data)
-		criteriaResult, err := parser.Query(criteria)
+	for _, ri := range remoteInterceptors(appId, resourceId, "before", action) {
+		riData, ok, err := matchCriteria(ri, data)
 		if err != nil {
 			return true, err
 		}
-
-		switch v := criteriaResult.(type) {
-		case []interface{}:
-			if len(v) == 0 {
-				return true, nil
-			}
-		case map[string]interface{}:
-			if v == nil {
-				return true, nil
-			}
-		default:
-			return true, nil
+		if !ok {
+			continue
+		}
+		payload, err := this.createPayload(resourceId, "before_"+action, riData)
+		if err != nil {
+			return false, err
+		}
+		ok, err = this.checkAgainstBeforeRemoteInterceptor(tx, db, context, payload, appId, resourceId, action, ri, target)
+		if !ok || err != nil {
+			return ok, err
 		}
-		data = criteriaResult
-	}
-
-	payload, err := this.createPayload(resourceId, "before_"+action, data)
-	if err != nil {
-		return false, err
 	}
-
-	return this.checkAgainstBeforeRemoteInterceptor(tx, db, context, payload, appId, resourceId, action, ri)
+	return true, nil
 }
 
-func (this *GlobalRemoteInterceptor) commonAfter(resourceId string, context map[string]interface{}, action string, data interface{}) error {
+// commonAfter queues an event for every after interceptor it matches. All
+// of them are queued even when one fails, the first error is returned.
+func (this *GlobalRemoteInterceptor) commonAfter(tx *sql.Tx, db *sql.DB, resourceId string, context map[string]interface{}, action string, data interface{}) error {
+	if isDryRun(context) {
+		return nil
+	}
 	rts := strings.Split(strings.Replace(resourceId, "`", "", -1), ".")
 	resourceId = rts[len(rts)-1]
 	appId := context["app_id"].(string)
-	key := strings.Join([]string{"ri", appId, resourceId, "after", action}, ":")
-	ri := gorest2.RedisLocal.HGetAllMap(key).Val()
-	if len(ri) == 0 {
-		return nil
-	}
-
-	criteria := ri["criteria"]
-	if len(strings.TrimSpace(criteria)) > 0 {
-		parser := jsonql.NewQuery(data)
-		criteriaResult, err := parser.Query(criteria)
-		if err != nil {
-			return err
-		}
-
-		switch v := criteriaResult.(type) {
-		case []interface{}:
-			if len(v) == 0 {
-				return nil
+	var ret error
+	for _, ri := range remoteInterceptors(appId, resourceId, "after", action) {
+		riData, ok, err := matchCriteria(ri, data)
+		if err == nil && ok {
+			var payload string
+			payload, err = this.createPayload(resourceId, "after_"+action, riData)
+			if err == nil {
+				err = this.executeAfterRemoteInterceptor(tx, db, payload, appId, resourceId, action, ri, context)
 			}
-		case map[string]interface{}:
-			if v == nil {
-				return nil
-			}
-		default:
-			return nil
 		}
-		data = criteriaResult
-	}
-	payload, err := this.createPayload(resourceId, "after_"+action, data)
-	if err != nil {
-		return err
+		if err != nil && ret == nil {
+			ret = err
+		}
 	}
-	return this.executeAfterRemoteInterceptor(payload, appId, resourceId, action, ri, context)
+	return ret
 }
 
 func (this *GlobalRemoteInterceptor) createPayload(target string, action string, data interface{}) (string, error) {
@@ -241,100 +385,106 @@ func (this *GlobalRemoteInterceptor) createPayload(target string, action string,
 }
 
 func (this *GlobalRemoteInterceptor) BeforeCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
-	ret, err := this.commonBefore(nil, db, resourceId, context, "create", data)
+	ret, err := this.commonBefore(nil, db, resourceId, context, "create", data, &riPatchTarget{Rows: data})
 	if !ret || err != nil {
 		return ret, err
 	}
 	return ret, nil
 }
 func (this *GlobalRemoteInterceptor) AfterCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) error {
-	err := this.commonAfter(resourceId, context, "create", data)
+	err := this.commonAfter(nil, db, resourceId, context, "create", data)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func (this *GlobalRemoteInterceptor) BeforeLoad(resourceId string, db *sql.DB, fields string, context map[string]interface{}, id string) (bool, error) {
-	return this.commonBefore(nil, db, resourceId, context, "load", map[string]string{"id": id})
+	return this.commonBefore(nil, db, resourceId, context, "load", map[string]string{"id": id}, nil)
 }
 func (this *GlobalRemoteInterceptor) AfterLoad(resourceId string, db *sql.DB, fields string, context map[string]interface{}, data map[string]string) error {
-	return this.commonAfter(resourceId, context, "load", data)
+	return this.commonAfter(nil, db, resourceId, context, "load", data)
 }
 func (this *GlobalRemoteInterceptor) BeforeUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
-	ret, err := this.commonBefore(nil, db, resourceId, context, "update", data)
+	ret, err := this.commonBefore(nil, db, resourceId, context, "update", data, &riPatchTarget{Rows: data})
 	if !ret || err != nil {
 		return ret, err
 	}
 	return ret, nil
 }
 func (this *GlobalRemoteInterceptor) AfterUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) error {
-	err := this.commonAfter(resourceId, context, "update", data)
+	err := this.commonAfter(nil, db, resourceId, context, "update", data)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func (this *GlobalRemoteInterceptor) BeforeDuplicate(resourceId string, db *sql.DB, context map[string]interface{}, id []string) (bool, error) {
-	ret, err := this.commonBefore(nil, db, resourceId, context, "duplicate", map[string][]string{"id": id})
+	ret, err := this.commonBefore(nil, db, resourceId, context, "duplicate", map[string][]string{"id": id}, nil)
 	if !ret || err != nil {
 		return ret, err
 	}
 	return ret, nil
 }
 func (this *GlobalRemoteInterceptor) AfterDuplicate(resourceId string, db *sql.DB, context map[string]interface{}, id []string, newId []string) error {
-	err := this.commonAfter(resourceId, context, "duplicate", map[string][]string{"new_id": newId})
+	err := this.commonAfter(nil, db, resourceId, context, "duplicate", map[string][]string{"new_id": newId})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func (this *GlobalRemoteInterceptor) BeforeDelete(resourceId string, db *sql.DB, context map[string]interface{}, id []string) (bool, error) {
-	ret, err := this.commonBefore(nil, db, resourceId, context, "delete", map[string][]string{"id": id})
+	ret, err := this.commonBefore(nil, db, resourceId, context, "delete", map[string][]string{"id": id}, nil)
 	if !ret || err != nil {
 		return ret, err
 	}
 	return ret, nil
 }
 func (this *GlobalRemoteInterceptor) AfterDelete(resourceId string, db *sql.DB, context map[string]interface{}, id []string) error {
-	err := this.commonAfter(resourceId, context, "delete", map[string][]string{"id": id})
+	err := this.commonAfter(nil, db, resourceId, context, "delete", map[string][]string{"id": id})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func (this *GlobalRemoteInterceptor) BeforeListMap(resourceId string, db *sql.DB, fields string, context map[string]interface{}, filter *string, sort *string, group *string, start int64, limit int64) (bool, error) {
-	return this.commonBefore(nil, db, resourceId, context, "list_map", map[string]interface{}{"fields": fields, "filter": *filter, "sort": *sort, "group": *group, "start": start, "limit": limit})
+	return this.commonBefore(nil, db, resourceId, context, "list_map", map[string]interface{}{"fields": fields, "filter": *filter, "sort": *sort, "group": *group, "start": start, "limit": limit}, nil)
 }
 func (this *GlobalRemoteInterceptor) AfterListMap(resourceId string, db *sql.DB, fields string, context map[string]interface{}, data *[]map[string]string, total int64) error {
-	return this.commonAfter(resourceId, context, "list_map", *data)
+	return this.commonAfter(nil, db, resourceId, context, "list_map", *data)
 }
 func (this *GlobalRemoteInterceptor) BeforeListArray(resourceId string, db *sql.DB, fields string, context map[string]interface{}, filter *string, sort *string, group *string, start int64, limit int64) (bool, error) {
-	return this.commonBefore(nil, db, resourceId, context, "list_array", map[string]interface{}{"fields": fields, "filter": *filter, "sort": *sort, "group": *group, "start": start, "limit": limit})
+	return this.commonBefore(nil, db, resourceId, context, "list_array", map[string]interface{}{"fields": fields, "filter": *filter, "sort": *sort, "group": *group, "start": start, "limit": limit}, nil)
 }
 func (this *GlobalRemoteInterceptor) AfterListArray(resourceId string, db *sql.DB, fields string, context map[string]interface{}, headers *[]string, data *[][]string, total int64) error {
-	return this.commonAfter(resourceId, context, "list_array", map[string]interface{}{"headers": *headers, "data": *data})
+	return this.commonAfter(nil, db, resourceId, context, "list_array", map[string]interface{}{"headers": *headers, "data": *data})
 }
 func (this *GlobalRemoteInterceptor) BeforeQueryMap(resourceId string, script string, params *[]interface{}, db *sql.DB, context map[string]interface{}) (bool, error) {
-	return this.commonBefore(nil, db, resourceId, context, "query_map", map[string]interface{}{"params": *params})
+	return this.commonBefore(nil, db, resourceId, context, "query_map", map[string]interface{}{"params": *params}, nil)
+}
+func (this *GlobalRemoteInterceptor) HasAfterQuery(resourceId string, context map[string]interface{}) bool {
+	rts := strings.Split(strings.Replace(resourceId, "`", "", -1), ".")
+	appId, _ := context["app_id"].(string)
+	return len(remoteInterceptors(appId, rts[len(rts)-1], "after", "query_map")) > 0
 }
 func (this *GlobalRemoteInterceptor) AfterQueryMap(resourceId string, script string, params *[]interface{}, db *sql.DB, context map[string]interface{}, data *[]map[string]string) error {
-	return this.commonAfter(resourceId, context, "query_map", *data)
+	return this.commonAfter(nil, db, resourceId, context, "query_map", *data)
 }
 func (this *GlobalRemoteInterceptor) BeforeQueryArray(resourceId string, script string, params *[]interface{}, db *sql.DB, context map[string]interface{}) (bool, error) {
-	return this.commonBefore(nil, db, resourceId, context, "query_array", map[string]interface{}{"params": *params})
+	return this.commonBefore(nil, db, resourceId, context, "query_array", map[string]interface{}{"params": *params}, nil)
 }
 func (this *GlobalRemoteInterceptor) AfterQueryArray(resourceId string, script string, params *[]interface{}, db *sql.DB, context map[string]interface{}, headers *[]string, data *[][]string) error {
-	return this.commonAfter(resourceId, context, "query_array", map[string]interface{}{"headers": *headers, "data": *data})
+	return this.commonAfter(nil, db, resourceId, context, "query_array", map[string]interface{}{"headers": *headers, "data": *data})
 }
 func (this *GlobalRemoteInterceptor) BeforeExec(resourceId string, scripts string, params *[][]interface{}, queryParams []string, tx *sql.Tx, context map[string]interface{}) (bool, error) {
-	ret, err := this.commonBefore(tx, nil, resourceId, context, "exec", map[string]interface{}{"params": *params, "query_params": queryParams})
+	data := map[string]interface{}{"params": *params, "query_params": queryParams}
+	ret, err := this.commonBefore(tx, nil, resourceId, context, "exec", data, &riPatchTarget{Params: params, Data: data})
 	if !ret || err != nil {
 		return ret, err
 	}
 	return true, nil
 }
 func (this *GlobalRemoteInterceptor) AfterExec(resourceId string, scripts string, params *[][]interface{}, queryParams []string, tx *sql.Tx, context map[string]interface{}, rowsAffectedArray [][]int64) error {
-	err := this.commonAfter(resourceId, context, "exec", map[string]interface{}{"params": *params, "query_params": queryParams, "rows_affected": rowsAffectedArray})
+	err := this.commonAfter(tx, nil, resourceId, context, "exec", map[string]interface{}{"params": *params, "query_params": queryParams, "rows_affected": rowsAffectedArray})
 	if err != nil {
 		return err
 	}
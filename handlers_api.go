@@ -0,0 +1,559 @@
+// handlers
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elgs/gorest2"
+)
+
+// apiFunc serves /api. Stored queries are handled here, so they run under
+// the context of the request, everything else is passed on to gorest2.
+func apiFunc(w http.ResponseWriter, r *http.Request) {
+	flags := r.URL.Query()
+	if r.URL.Path == "/api/"+batchQueryName && r.Method == "POST" {
+		batchFunc(w, r)
+		return
+	}
+	if flags.Get("dry_run") != "" {
+		dryRunFunc(w, r)
+		return
+	}
+	if flags.Get("stream") != "" && r.Method == "GET" {
+		streamFunc(w, r)
+		return
+	}
+	if _, ok := flags["cursor"]; ok && r.Method == "GET" {
+		pageFunc(w, r)
+		return
+	}
+	if flags.Get("results") != "" && r.Method != "GET" {
+		execResultsFunc(w, r)
+		return
+	}
+	if query := loadApiQuery(r); query != nil {
+		if query["mode"] == "multi" {
+			multiFunc(w, r)
+			return
+		}
+		if query["shape"] != "" && r.Method == "GET" && flags.Get("raw") == "" {
+			shapeFunc(w, r)
+			return
+		}
+		queryFunc(w, r)
+		return
+	}
+	gorest2.RestFunc(w, r)
+}
+
+const missingQueryTTL = time.Minute
+
+// loadApiQuery loads the stored query a request is for, or returns nil when
+// it cannot be resolved, leaving the request to gorest2. Routes with an id
+// are table rows, and names found not to be queries are remembered for a
+// minute, so plain table requests do not look up the query table each time.
+func loadApiQuery(r *http.Request) map[string]string {
+	projectId := r.Header.Get("app_id")
+	if projectId == "" {
+		projectId = r.FormValue("app_id")
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	if projectId == "" || len(path) != 1 || path[0] == "" {
+		return nil
+	}
+	missingKey := missingQueryKey(projectId, path[0])
+	if gorest2.RedisLocal.Exists(missingKey).Val() {
+		return nil
+	}
+	query, err := loadQuery(projectId, path[0])
+	if err == errQueryNotFound {
+		gorest2.RedisMaster.Set(missingKey, "", missingQueryTTL)
+	}
+	if err != nil {
+		return nil
+	}
+	return query
+}
+
+func missingQueryKey(projectId, queryName string) string {
+	return fmt.Sprint("query_missing:", projectId, ":", queryName)
+}
+
+// queryFunc serves a plain stored query the way gorest2 would: reads with
+// the rows as maps, or as headers and arrays with the array flag, and
+// writes with the rows affected. The statement is killed when the client
+// goes away.
+func queryFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+
+	if r.Method == "GET" {
+		params := []interface{}{}
+		err = parseApiForm(r, "params", &params)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		if array := r.FormValue("array"); array == "true" || array == "1" {
+			headers, data, err := dbo.QueryArray(tableId, params, queryParams, context)
+			if err != nil {
+				m["err"] = err.Error()
+				writeJsonResponse(w, m)
+				return
+			}
+			m["headers"] = headers
+			m["data"] = data
+		} else {
+			data, err := dbo.QueryMap(tableId, params, queryParams, context)
+			if err != nil {
+				m["err"] = err.Error()
+				writeJsonResponse(w, m)
+				return
+			}
+			m["data"] = data
+		}
+	} else {
+		params := [][]interface{}{}
+		err = parseApiForm(r, "params", &params)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		data, err := dbo.Exec(tableId, params, queryParams, context)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = data
+	}
+	writeJsonResponse(w, m)
+}
+
+// shapeFunc serves a stored query with a shape as typed, nested JSON. The
+// raw flag gets the plain rows from gorest2 instead.
+func shapeFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	params := []interface{}{}
+	err = parseApiForm(r, "params", &params)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	data, err := dbo.QueryShaped(tableId, params, queryParams, context)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	m["data"] = data
+	writeJsonResponse(w, m)
+}
+
+func multiFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	params := []interface{}{}
+	err = parseApiForm(r, "params", &params)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	data, err := dbo.QueryMulti(tableId, params, queryParams, context)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	m["data"] = data
+	writeJsonResponse(w, m)
+}
+
+// pageFunc serves one page of a stored query with cursor keys. The first
+// page is requested with an empty cursor, the following ones with the
+// next_cursor of the previous response until it comes back empty.
+func pageFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	params := []interface{}{}
+	err = parseApiForm(r, "params", &params)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	flags := r.URL.Query()
+	data, nextCursor, err := dbo.QueryPage(tableId, params, queryParams, context, flags.Get("cursor"), parsePageSize(flags.Get("page_size")))
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	m["data"] = data
+	m["next_cursor"] = nextCursor
+	writeJsonResponse(w, m)
+}
+
+func dryRunFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	context["dry_run"] = true
+
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+
+	if r.Method == "GET" {
+		params := []interface{}{}
+		err = parseApiForm(r, "params", &params)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		data, err := dbo.DryRunQuery(tableId, params, queryParams, context)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = data
+	} else {
+		params := [][]interface{}{}
+		err = parseApiForm(r, "params", &params)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		data, err := dbo.DryRunExec(tableId, params, queryParams, context)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = data
+	}
+	writeJsonResponse(w, m)
+}
+
+func streamFunc(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("stream")
+	if format != "json" {
+		format = "ndjson"
+	}
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	params := []interface{}{}
+	err = parseApiForm(r, "params", &params)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	}
+	err = dbo.QueryStream(tableId, params, queryParams, context, w, format)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// execResultsFunc serves a writing stored query with the last insert id of
+// every statement, and the inserted rows with fetch_inserted.
+func execResultsFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, tableId, context, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	context["fetch_inserted"] = r.URL.Query().Get("fetch_inserted") != ""
+	queryParams := []string{}
+	err = parseApiForm(r, "query_params", &queryParams)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	params := [][]interface{}{}
+	err = parseApiForm(r, "params", &params)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	data, err := dbo.ExecResults(tableId, params, queryParams, context)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	m["data"] = data
+	writeJsonResponse(w, m)
+}
+
+// batchQueryName is the reserved query name batches are posted to.
+const batchQueryName = "_batch"
+
+const maxBatchItems = 50
+
+// batchItem is one stored query call of a batch. Params is a list of values
+// for reads and a list of lists for execs, like in single calls.
+type batchItem struct {
+	Query       string          `json:"query"`
+	Params      json.RawMessage `json:"params"`
+	QueryParams []string        `json:"query_params"`
+	Exec        bool            `json:"exec"`
+}
+
+// batchFunc serves /api/_batch, running the items posted in batch one after
+// another through the same pipeline as single calls. Each item gets either
+// data or err in the result. With tx set all items share one transaction,
+// and the first failing item rolls the whole batch back.
+func batchFunc(w http.ResponseWriter, r *http.Request) {
+	m := map[string]interface{}{}
+	dbo, _, batchContext, err := buildApiRequest(r)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	items := []*batchItem{}
+	err = parseApiForm(r, "batch", &items)
+	if err != nil {
+		m["err"] = err.Error()
+		writeJsonResponse(w, m)
+		return
+	}
+	if len(items) > maxBatchItems {
+		m["err"] = fmt.Sprint("Too many batch items, at most ", maxBatchItems, " allowed.")
+		writeJsonResponse(w, m)
+		return
+	}
+
+	var tx *queryTx
+	if shared := r.FormValue("tx"); shared == "true" || shared == "1" {
+		db, err := dbo.GetConn()
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		tx, err = beginGuardedTx(r.Context(), dbo.QueryTimeout(), db, nil)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+	}
+
+	results := []map[string]interface{}{}
+	failed := false
+	for _, item := range items {
+		result := map[string]interface{}{}
+		if failed {
+			result["err"] = "Batch rolled back."
+			results = append(results, result)
+			continue
+		}
+		// every item gets a fresh context, interceptors keep state in it
+		_, _, context, _ := buildApiRequest(r)
+		if tx != nil {
+			context["batch_tx"] = tx
+		}
+		data, err := runBatchItem(dbo, item, context)
+		if err != nil {
+			result["err"] = err.Error()
+			failed = tx != nil
+		} else {
+			result["data"] = data
+		}
+		results = append(results, result)
+	}
+
+	if tx != nil {
+		if failed {
+			tx.Rollback()
+			m["err"] = "Batch rolled back."
+		} else {
+			err = tx.Commit()
+			if err != nil {
+				m["err"] = err.Error()
+			} else {
+				invalidateQueryCache(batchContext["app_id"].(string), tx.written)
+				relayOutboxAfterCommit(batchContext["app_id"].(string), tx.outbox)
+			}
+		}
+	}
+	m["data"] = results
+	writeJsonResponse(w, m)
+}
+
+func runBatchItem(dbo *NdDataOperator, item *batchItem, context map[string]interface{}) (interface{}, error) {
+	if item.Query == "" || item.Query == batchQueryName {
+		return nil, errors.New("Invalid query.")
+	}
+	query, err := loadQuery(context["app_id"].(string), item.Query)
+	if err != nil {
+		return nil, err
+	}
+	if item.Exec {
+		params := [][]interface{}{}
+		if len(item.Params) > 0 {
+			err = json.Unmarshal(item.Params, &params)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dbo.ExecResults(item.Query, params, item.QueryParams, context)
+	}
+	params := []interface{}{}
+	if len(item.Params) > 0 {
+		err = json.Unmarshal(item.Params, &params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if query["mode"] == "multi" {
+		return dbo.QueryMulti(item.Query, params, item.QueryParams, context)
+	}
+	if query["shape"] != "" {
+		return dbo.QueryShaped(item.Query, params, item.QueryParams, context)
+	}
+	return dbo.QueryMap(item.Query, params, item.QueryParams, context)
+}
+
+// parseApiForm decodes the JSON encoded form value key into v, leaving v
+// untouched when the key is absent.
+func parseApiForm(r *http.Request, key string, v interface{}) error {
+	value := r.FormValue(key)
+	if value == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+// buildApiRequest resolves the project data operator, the stored query name
+// and the interceptor context of an /api/<query> request.
+func buildApiRequest(r *http.Request) (*NdDataOperator, string, map[string]interface{}, error) {
+	projectId := r.Header.Get("app_id")
+	token := r.Header.Get("token")
+	if projectId == "" {
+		projectId = r.FormValue("app_id")
+		token = r.FormValue("token")
+	}
+	if projectId == "" {
+		return nil, "", nil, errors.New("Invalid app.")
+	}
+	tableId := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")[0]
+	if tableId == "" {
+		return nil, "", nil, errors.New("Invalid query.")
+	}
+	dbo, ok := gorest2.GetDbo(projectId).(*NdDataOperator)
+	if !ok {
+		return nil, "", nil, errors.New("Invalid app.")
+	}
+	context := map[string]interface{}{
+		"app_id":      projectId,
+		"token":       token,
+		"case":        r.FormValue("case"),
+		"client_ip":   requestClientIp(r),
+		"meta":        false,
+		"request_ctx": r.Context(),
+	}
+	return dbo, tableId, context, nil
+}
+
+func requestClientIp(r *http.Request) string {
+	clientIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return clientIp
+}
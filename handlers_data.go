@@ -201,6 +201,7 @@ func init() {
 				return
 			}
 		}
+		invalidateQueryCache(projectId, []string{normalizeTableName(table)})
 		fmt.Fprint(w, "Data loaded.")
 	})
 
@@ -253,7 +254,7 @@ func init() {
 
 		ms := make([]map[string]interface{}, 0, len(sqls))
 
-		tx, err := db.Begin()
+		tx, err := beginGuardedTx(r.Context(), projectQueryTimeout(dbo), db, nil)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -264,17 +265,18 @@ func init() {
 			}
 			m := map[string]interface{}{}
 
-			rowsAffected, err := exec(tx, sql)
+			rowsAffected, err := exec(tx.Tx, sql)
 			m["rowsAffected"] = rowsAffected
 
 			if err != nil {
 				tx.Rollback()
-				m["err"] = err.Error()
+				m["err"] = tx.queryError(err).Error()
 				fmt.Println(err)
 			}
 			ms = append(ms, m)
 		}
 		tx.Commit()
+		invalidateQueryCache(projectId, writtenTables(userSql))
 
 		jsonData, err := json.Marshal(ms)
 		if err != nil {
@@ -321,12 +323,16 @@ func init() {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tx, err := db.Begin()
+		tx, err := beginGuardedTx(r.Context(), projectQueryTimeout(dbo), db, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		m, err := query(tx, sql, pageNumber, pageSize, order, dir, mode)
+		m, err := query(tx.Tx, sql, pageNumber, pageSize, order, dir, mode)
 		if err != nil {
 			tx.Rollback()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, tx.queryError(err).Error(), http.StatusInternalServerError)
 			return
 		} else {
 			tx.Commit()
@@ -385,7 +391,7 @@ func init() {
 			return
 		}
 
-		tx, err := db.Begin()
+		tx, err := beginGuardedTx(r.Context(), projectQueryTimeout(dbo), db, nil)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -395,11 +401,11 @@ func init() {
 				continue
 			}
 			if isQuery(sql) {
-				m, err := query(tx, sql, pageNumber, pageSize, order, dir, mode)
+				m, err := query(tx.Tx, sql, pageNumber, pageSize, order, dir, mode)
 				if err != nil {
 					tx.Rollback()
 					m = map[string]interface{}{}
-					m["err"] = err.Error()
+					m["err"] = tx.queryError(err).Error()
 					m["sql"] = sql
 					fmt.Println(err)
 					ms = append(ms, m)
@@ -408,10 +414,10 @@ func init() {
 				ms = append(ms, m)
 			} else {
 				m := map[string]interface{}{}
-				rowsAffected, err := exec(tx, sql)
+				rowsAffected, err := exec(tx.Tx, sql)
 				if err != nil {
 					tx.Rollback()
-					m["err"] = err.Error()
+					m["err"] = tx.queryError(err).Error()
 					m["sql"] = sql
 					fmt.Println(err)
 					ms = append(ms, m)
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/elgs/cron"
 	"github.com/elgs/gorest2"
@@ -46,10 +45,18 @@ func init() {
 					tx.Rollback()
 					return
 				}
+				identifierRules, err := parseIdentifierRules(job["IDENTIFIERS"])
+				if err != nil {
+					fmt.Println(err)
+					tx.Rollback()
+					return
+				}
 				for _, row := range loopData {
-					scriptReplaced := script
-					for i, v := range row {
-						scriptReplaced = strings.Replace(script, fmt.Sprint("$", i), v, -1)
+					scriptReplaced, err := substituteQueryParams(script, row, identifierRules)
+					if err != nil {
+						fmt.Println(err)
+						tx.Rollback()
+						return
 					}
 
 					scriptsArray, err := gosplitargs.SplitArgs(scriptReplaced, ";", true)
@@ -64,7 +71,15 @@ func init() {
 						if len(s) == 0 {
 							continue
 						}
-						_, err = gosqljson.ExecTx(tx, s)
+						// the values of the loop row are bound, only those
+						// with an identifier rule are substituted
+						s, args, err := bindQueryParamValues(s, nil, row, identifierRules)
+						if err != nil {
+							tx.Rollback()
+							fmt.Println(err)
+							return
+						}
+						_, err = gosqljson.ExecTx(tx, s, args...)
 						if err != nil {
 							tx.Rollback()
 							fmt.Println(err)
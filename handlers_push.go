@@ -0,0 +1,188 @@
+// handlers_push
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+)
+
+func init() {
+	gorest2.RegisterHandler("/push_dead_letters", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		db, projectId, _, err := checkProjectForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		start, limit := parsePushPaging(r)
+		data, err := gosqljson.QueryDbToMap(db, "upper",
+			`SELECT * FROM push_notification WHERE PROJECT_ID=? AND STATUS=?
+			ORDER BY UPDATE_TIME DESC LIMIT ?,?`, projectId, pushStatusDead, start, limit)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = data
+		writeJsonResponse(w, m)
+	})
+
+	gorest2.RegisterHandler("/push_attempts", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		db, projectId, _, err := checkProjectForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		query := `SELECT * FROM push_notification_attempt WHERE PROJECT_ID=?`
+		params := []interface{}{projectId}
+		if id := r.FormValue("notification_id"); id != "" {
+			query += " AND PUSH_NOTIFICATION_ID=?"
+			params = append(params, id)
+		}
+		from, to, err := parsePushTimeRange(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		if from != "" {
+			query += " AND CREATE_TIME>=?"
+			params = append(params, from)
+		}
+		if to != "" {
+			query += " AND CREATE_TIME<?"
+			params = append(params, to)
+		}
+		start, limit := parsePushPaging(r)
+		query += " ORDER BY CREATE_TIME DESC LIMIT ?,?"
+		params = append(params, start, limit)
+		data, err := gosqljson.QueryDbToMap(db, "upper", query, params...)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = data
+		writeJsonResponse(w, m)
+	})
+
+	gorest2.RegisterHandler("/push_replay", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		if r.Method != "POST" {
+			m["err"] = "Method not allowed."
+			writeJsonResponse(w, m)
+			return
+		}
+		db, projectId, userToken, err := checkProjectForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		from, to, err := parsePushTimeRange(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		replay := &pushReplay{
+			From: from,
+			To:   to,
+			All:  r.FormValue("all") == "true",
+		}
+		for _, id := range strings.Split(r.FormValue("id"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				replay.Ids = append(replay.Ids, id)
+			}
+		}
+		rowsAffected, err := replayPushNotifications(db, projectId, replay, userToken)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = rowsAffected
+		writeJsonResponse(w, m)
+	})
+}
+
+// checkProjectForDev makes sure the dev token of the request belongs to the
+// creator or a member of the project given by project_id.
+func checkProjectForDev(r *http.Request) (*sql.DB, string, map[string]string, error) {
+	token := r.Header.Get("token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	_, userToken, err := checkDefaultToken(token, "netdata.project")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defaultDbo := gorest2.GetDbo("default")
+	db, err := defaultDbo.GetConn()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	projectId := r.FormValue("project_id")
+	projectData, err := gosqljson.QueryDbToMap(db, "upper",
+		`SELECT ID FROM project WHERE ID=? AND (CREATOR_ID=?
+		OR EXISTS (SELECT 1 FROM user_project WHERE project.ID=user_project.PROJECT_ID AND user_project.USER_EMAIL=?))`,
+		projectId, userToken["ID"], userToken["EMAIL"])
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if len(projectData) == 0 {
+		return nil, "", nil, errors.New("Project not found.")
+	}
+	return db, projectId, userToken, nil
+}
+
+// parsePushTimeRange reads from and to, in any of the layouts of datetime
+// query params, as UTC times in the layout of CREATE_TIME.
+func parsePushTimeRange(r *http.Request) (string, string, error) {
+	from, err := parsePushTime("from", r.FormValue("from"))
+	if err != nil {
+		return "", "", err
+	}
+	to, err := parsePushTime("to", r.FormValue("to"))
+	if err != nil {
+		return "", "", err
+	}
+	return from, to, nil
+}
+
+func parsePushTime(name, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	for _, layout := range paramTimeLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC().Format("2006-01-02 15:04:05"), nil
+		}
+	}
+	return "", errors.New(fmt.Sprint("Invalid ", name, ": ", value))
+}
+
+func parsePushPaging(r *http.Request) (int64, int64) {
+	start, _ := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		limit = 25
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start, limit
+}
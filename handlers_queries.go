@@ -0,0 +1,138 @@
+// handlers
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+)
+
+func init() {
+	gorest2.RegisterHandler("/query_versions", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		db, queryRow, err := loadQueryForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		versions, err := gosqljson.QueryDbToMap(db, "upper",
+			`SELECT * FROM query_version
+			WHERE QUERY_ID=? ORDER BY VERSION DESC`, queryRow["ID"])
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["active_version"] = queryRow["ACTIVE_VERSION"]
+		m["data"] = versions
+		writeJsonResponse(w, m)
+	})
+
+	gorest2.RegisterHandler("/query_version_diff", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		db, queryRow, err := loadQueryForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		versions, err := gosqljson.QueryDbToMap(db, "upper",
+			`SELECT * FROM query_version WHERE QUERY_ID=? AND VERSION IN (?,?)`,
+			queryRow["ID"], r.FormValue("from"), r.FormValue("to"))
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		var from, to map[string]string
+		for _, version := range versions {
+			if version["VERSION"] == r.FormValue("from") {
+				from = version
+			}
+			if version["VERSION"] == r.FormValue("to") {
+				to = version
+			}
+		}
+		if from == nil || to == nil {
+			m["err"] = "Query version not found."
+			writeJsonResponse(w, m)
+			return
+		}
+		diff := map[string][]string{}
+		for _, field := range queryFields {
+			diff[field] = diffLines(from[field], to[field])
+		}
+		m["data"] = diff
+		writeJsonResponse(w, m)
+	})
+
+	gorest2.RegisterHandler("/query_rollback", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		if r.Method != "POST" {
+			m["err"] = "Method not allowed."
+			writeJsonResponse(w, m)
+			return
+		}
+		db, queryRow, err := loadQueryForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		version := r.FormValue("version")
+		err = rollbackQuery(db, queryRow, version)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = version
+		writeJsonResponse(w, m)
+	})
+}
+
+// loadQueryForDev loads the query given by query_id, provided the dev token
+// of the request belongs to its creator or a member of its project.
+func loadQueryForDev(r *http.Request) (*sql.DB, map[string]string, error) {
+	token := r.Header.Get("token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	_, userToken, err := checkDefaultToken(token, "netdata.query")
+	if err != nil {
+		return nil, nil, err
+	}
+	defaultDbo := gorest2.GetDbo("default")
+	db, err := defaultDbo.GetConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	queryData, err := gosqljson.QueryDbToMap(db, "upper",
+		`SELECT * FROM query WHERE ID=? AND (CREATOR_ID=?
+		OR EXISTS (SELECT 1 FROM user_project WHERE query.PROJECT_ID=user_project.PROJECT_ID AND user_project.USER_EMAIL=?))`,
+		r.FormValue("query_id"), userToken["ID"], userToken["EMAIL"])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(queryData) == 0 {
+		return nil, nil, errors.New("Query not found.")
+	}
+	return db, queryData[0], nil
+}
+
+func writeJsonResponse(w http.ResponseWriter, m interface{}) {
+	jsonData, err := json.Marshal(m)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, string(jsonData))
+}
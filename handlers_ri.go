@@ -0,0 +1,233 @@
+// handlers_ri
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+)
+
+const maxTestFireResponseBytes = 64 * 1024
+
+func init() {
+	// ri_test_fire sends a sample payload to the remote interceptor given by
+	// ri_id the way a real event would, and reports the request, the
+	// response, the patch it answered with and the statements its callback
+	// would run. Nothing is written: the callback is only prepared, and the
+	// circuit breaker and push queue are left alone. The call is marked as a
+	// test, see riTestHeader, and the callback sees the context of the dev
+	// user as if they had made the change.
+	gorest2.RegisterHandler("/ri_test_fire", func(w http.ResponseWriter, r *http.Request) {
+		m := map[string]interface{}{}
+		if r.Method != "POST" {
+			m["err"] = "Method not allowed."
+			writeJsonResponse(w, m)
+			return
+		}
+		riRow, userToken, err := loadRiForDev(r)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		context := map[string]interface{}{
+			"app_id":          riRow["PROJECT_ID"],
+			"client_ip":       requestClientIp(r),
+			"request_time":    time.Now().UTC(),
+			"user_id":         userToken["ID"],
+			"email":           userToken["EMAIL"],
+			"token_user_id":   userToken["ID"],
+			"token_user_code": userToken["EMAIL"],
+		}
+		result, err := testFireRemoteInterceptor(riRow, r.FormValue("payload"), context)
+		if err != nil {
+			m["err"] = err.Error()
+			writeJsonResponse(w, m)
+			return
+		}
+		m["data"] = result
+		writeJsonResponse(w, m)
+	})
+}
+
+// loadRiForDev loads the remote interceptor given by ri_id, provided the dev
+// token of the request belongs to its creator or a member of its project.
+func loadRiForDev(r *http.Request) (map[string]string, map[string]string, error) {
+	token := r.Header.Get("token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	_, userToken, err := checkDefaultToken(token, "netdata.remote_interceptor")
+	if err != nil {
+		return nil, nil, err
+	}
+	defaultDbo := gorest2.GetDbo("default")
+	db, err := defaultDbo.GetConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	riData, err := gosqljson.QueryDbToMap(db, "upper",
+		`SELECT * FROM remote_interceptor WHERE ID=? AND (CREATOR_ID=?
+		OR EXISTS (SELECT 1 FROM user_project WHERE remote_interceptor.PROJECT_ID=user_project.PROJECT_ID AND user_project.USER_EMAIL=?))`,
+		r.FormValue("ri_id"), userToken["ID"], userToken["EMAIL"])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(riData) == 0 {
+		return nil, nil, errors.New("Remote interceptor not found.")
+	}
+	err = ensureRiSecret(db, riData[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return riData[0], userToken, nil
+}
+
+// testFireRemoteInterceptor runs the criteria of a remote interceptor on
+// sample, the data of an event as its interceptor would see it, and sends
+// the payload the event would raise.
+func testFireRemoteInterceptor(riRow map[string]string, sample string, context map[string]interface{}) (map[string]interface{}, error) {
+	_, entry, err := remoteInterceptorEntry(riRow)
+	if err != nil {
+		return nil, err
+	}
+	ri := map[string]string{}
+	err = json.Unmarshal([]byte(entry), &ri)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	if strings.TrimSpace(sample) != "" {
+		// decoded like the data of a real write, so criteria compare
+		// numbers the same way
+		err = json.Unmarshal([]byte(sample), &data)
+		if err != nil {
+			return nil, errors.New("Invalid payload: " + err.Error())
+		}
+	}
+
+	result := map[string]interface{}{}
+	riData, ok, err := matchCriteria(ri, data)
+	if err != nil {
+		return nil, err
+	}
+	result["matched"] = ok
+	if !ok {
+		return result, nil
+	}
+
+	theType := riRow["TYPE"]
+	payload, err := (&GlobalRemoteInterceptor{}).createPayload(riRow["TARGET"], theType+"_"+riRow["ACTION_TYPE"], riData)
+	if err != nil {
+		return nil, err
+	}
+	deliveryId := newTestDeliveryId()
+	opts, err := parseRiOptions(ri, deliveryId, payload)
+	if err != nil {
+		return nil, err
+	}
+	result["request"] = map[string]interface{}{
+		"method":  ri["method"],
+		"url":     ri["url"],
+		"headers": json.RawMessage(redactHeaders(opts.Header)),
+		"body":    payload,
+	}
+
+	start := time.Now()
+	res, statusCode, err := httpRequest(ri["url"], ri["method"], payload, maxTestFireResponseBytes, opts)
+	response := map[string]interface{}{
+		"duration_ms": int64(time.Since(start) / time.Millisecond),
+	}
+	result["response"] = response
+	if err != nil {
+		response["err"] = err.Error()
+		return result, nil
+	}
+	response["status_code"] = statusCode
+	response["body"] = string(res)
+	if statusCode != 200 {
+		if theType == "before" {
+			response["err"] = "Client rejected."
+		}
+		return result, nil
+	}
+
+	if theType == "before" {
+		patch, err := parseRiPatch(string(res))
+		if err != nil {
+			result["patch_err"] = err.Error()
+		} else if patch != nil {
+			result["patch"] = patch
+			target := testFirePatchTarget(riRow["ACTION_TYPE"], data)
+			err = patch.validate(target)
+			if err != nil {
+				result["patch_err"] = err.Error()
+			} else {
+				patch.apply(target)
+				result["patched"] = data
+			}
+		}
+	}
+
+	if strings.TrimSpace(ri["callback"]) != "" {
+		callback := map[string]interface{}{"query": ri["callback"]}
+		result["callback"] = callback
+		statements, err := prepareTestFireCallback(riRow["PROJECT_ID"], ri["callback"], string(res), context)
+		if err != nil {
+			callback["err"] = err.Error()
+		} else {
+			callback["statements"] = statements
+		}
+	}
+	return result, nil
+}
+
+// testFirePatchTarget finds what a patch would apply to in sample data:
+// the rows of create and update, the params of exec.
+func testFirePatchTarget(action string, data interface{}) *riPatchTarget {
+	switch action {
+	case "create", "update":
+		items, _ := data.([]interface{})
+		rows := []map[string]interface{}{}
+		for _, item := range items {
+			if row, ok := item.(map[string]interface{}); ok {
+				rows = append(rows, row)
+			}
+		}
+		return &riPatchTarget{Rows: rows}
+	case "exec":
+		dataMap, _ := data.(map[string]interface{})
+		if dataMap == nil {
+			return nil
+		}
+		params := [][]interface{}{}
+		items, _ := dataMap["params"].([]interface{})
+		for _, item := range items {
+			row, _ := item.([]interface{})
+			params = append(params, row)
+		}
+		return &riPatchTarget{Params: &params, Data: dataMap}
+	}
+	return nil
+}
+
+// prepareTestFireCallback binds the response to the statements of the
+// callback query without running them, in the context of the test fire.
+func prepareTestFireCallback(projectId, callback, clientData string, context map[string]interface{}) ([][]*SqlStatement, error) {
+	query, err := loadQuery(projectId, callback)
+	if err != nil {
+		return nil, err
+	}
+	scripts := query["script"]
+	contextVars := buildContextVars(context)
+	queryParams, params, err := buildParams(clientData)
+	if err != nil {
+		return nil, err
+	}
+	return prepareBatch(query, &scripts, queryParams, params, contextVars)
+}
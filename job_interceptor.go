@@ -17,7 +17,23 @@ type JobInterceptor struct {
 	Id string
 }
 
+func checkJobIdentifiers(data []map[string]interface{}) error {
+	for _, data1 := range data {
+		if schema, ok := data1["IDENTIFIERS"].(string); ok {
+			_, err := parseIdentifierRules(schema)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (this *JobInterceptor) BeforeCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	err := checkJobIdentifiers(data)
+	if err != nil {
+		return false, err
+	}
 	for _, data1 := range data {
 		data1["CRON"] = fmt.Sprintf("%s %s", "0", data1["CRON"])
 	}
@@ -42,6 +58,10 @@ func (this *JobInterceptor) AfterCreate(resourceId string, db *sql.DB, context m
 	return nil
 }
 func (this *JobInterceptor) BeforeUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	err := checkJobIdentifiers(data)
+	if err != nil {
+		return false, err
+	}
 	for _, data1 := range data {
 		data1["CRON"] = fmt.Sprintf("%s %s", "0", data1["CRON"])
 	}
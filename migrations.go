@@ -0,0 +1,329 @@
+// migrations
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elgs/gosqljson"
+)
+
+// A migration is a one-off change to the default database, for changes of
+// behavior existing data has to be adapted to. Migrations run in order at
+// startup, under a database lock so nodes starting together do not race,
+// and are recorded in nd_migration so each runs once.
+type migration struct {
+	Id      string
+	Migrate func(db *sql.DB) error
+}
+
+const createMigrationTable = `CREATE TABLE IF NOT EXISTS nd_migration (
+	ID VARCHAR(64) NOT NULL PRIMARY KEY,
+	CREATE_TIME DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8 COLLATE utf8_unicode_ci`
+
+const migrationLockTimeout = 60
+
+const createQueryVersionTable = `CREATE TABLE IF NOT EXISTS query_version (
+	ID VARCHAR(32) NOT NULL PRIMARY KEY,
+	QUERY_ID VARCHAR(32) NOT NULL,
+	PROJECT_ID VARCHAR(32) NOT NULL,
+	NAME VARCHAR(255) NOT NULL,
+	VERSION INT NOT NULL,
+	SCRIPT TEXT,
+	PARAMS TEXT,
+	IDENTIFIERS TEXT,
+	CREATOR_ID VARCHAR(32),
+	CREATOR_CODE VARCHAR(255),
+	CREATE_TIME DATETIME,
+	UNIQUE KEY QUERY_VERSION_UK (QUERY_ID, VERSION)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8 COLLATE utf8_unicode_ci`
+
+const createPushAttemptTable = `CREATE TABLE IF NOT EXISTS push_notification_attempt (
+	ID VARCHAR(32) NOT NULL PRIMARY KEY,
+	PUSH_NOTIFICATION_ID VARCHAR(32) NOT NULL,
+	PROJECT_ID VARCHAR(32) NOT NULL,
+	ATTEMPT INT NOT NULL,
+	URL TEXT,
+	METHOD VARCHAR(16),
+	REQUEST_HEADERS TEXT,
+	STATUS_CODE INT,
+	RESPONSE TEXT,
+	DURATION_MS BIGINT,
+	ERROR TEXT,
+	CREATE_TIME DATETIME NOT NULL,
+	KEY PUSH_NOTIFICATION_ID (PUSH_NOTIFICATION_ID),
+	KEY PROJECT_ID_CREATE_TIME (PROJECT_ID, CREATE_TIME)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8 COLLATE utf8_unicode_ci`
+
+var migrations = []*migration{
+	// parameter schemas of queries
+	{"query_params", func(db *sql.DB) error {
+		return addColumn(db, "query", "PARAMS", "TEXT")
+	}},
+	// identifier rules of $N query params of queries and jobs
+	{"query_identifiers", func(db *sql.DB) error {
+		err := addColumn(db, "query", "IDENTIFIERS", "TEXT")
+		if err != nil {
+			return err
+		}
+		return addColumn(db, "job", "IDENTIFIERS", "TEXT")
+	}},
+	// queries keep each saved definition as a version
+	{"query_version", func(db *sql.DB) error {
+		_, err := gosqljson.ExecDb(db, createQueryVersionTable)
+		if err != nil {
+			return err
+		}
+		exists, err := indexExists(db, "query_version", "QUERY_VERSION_UK")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			_, err = gosqljson.ExecDb(db, `ALTER TABLE query_version ADD UNIQUE KEY QUERY_VERSION_UK (QUERY_ID, VERSION)`)
+			if err != nil {
+				return err
+			}
+		}
+		return addColumn(db, "query", "ACTIVE_VERSION", "INT")
+	}},
+	// keyset pagination of queries
+	{"query_cursor", func(db *sql.DB) error {
+		return addQueryField(db, "CURSOR", "TEXT")
+	}},
+	// result caching of queries
+	{"query_cache", func(db *sql.DB) error {
+		err := addQueryField(db, "CACHE_TTL", "INT")
+		if err != nil {
+			return err
+		}
+		return addQueryField(db, "CACHE_DEPENDS", "TEXT")
+	}},
+	// how the statements of a multi statement query are run
+	{"query_mode", func(db *sql.DB) error {
+		return addQueryField(db, "MODE", "VARCHAR(16)")
+	}},
+	// transaction options of queries
+	{"query_tx_options", func(db *sql.DB) error {
+		err := addQueryField(db, "ISOLATION_LEVEL", "VARCHAR(32)")
+		if err != nil {
+			return err
+		}
+		return addQueryField(db, "READ_ONLY", "VARCHAR(8)")
+	}},
+	// statement timeouts of queries and projects, in seconds
+	{"query_timeout", func(db *sql.DB) error {
+		err := addQueryField(db, "TIMEOUT", "DOUBLE")
+		if err != nil {
+			return err
+		}
+		return addColumn(db, "project", "QUERY_TIMEOUT", "DOUBLE")
+	}},
+	// shapes of query results
+	{"query_shape", func(db *sql.DB) error {
+		return addQueryField(db, "SHAPE", "TEXT")
+	}},
+	// retry policies of remote interceptors, copied to the notifications
+	// they queue, and the delivery state of notifications
+	{"push_retry", func(db *sql.DB) error {
+		columns := []struct{ Table, Column, Definition string }{
+			{"remote_interceptor", "MAX_ATTEMPTS", "INT"},
+			{"remote_interceptor", "BACKOFF", "TEXT"},
+			{"remote_interceptor", "RETRY_STATUS_CODES", "TEXT"},
+			{"push_notification", "RI_ID", "VARCHAR(32)"},
+			{"push_notification", "MAX_ATTEMPTS", "INT"},
+			{"push_notification", "BACKOFF", "TEXT"},
+			{"push_notification", "RETRY_STATUS_CODES", "TEXT"},
+			{"push_notification", "ATTEMPTS", "INT NOT NULL DEFAULT 0"},
+			{"push_notification", "LAST_ERROR", "TEXT"},
+			{"push_notification", "NEXT_ATTEMPT_TIME", "DATETIME"},
+		}
+		for _, c := range columns {
+			err := addColumn(db, c.Table, c.Column, c.Definition)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	// signing secrets of remote interceptors
+	{"ri_secret", func(db *sql.DB) error {
+		return addColumn(db, "remote_interceptor", "SECRET", "VARCHAR(255)")
+	}},
+	// request options of remote interceptors
+	{"ri_options", func(db *sql.DB) error {
+		columns := []struct{ Column, Definition string }{
+			{"HEADERS", "TEXT"},
+			{"AUTH_TYPE", "VARCHAR(16)"},
+			{"AUTH_CREDENTIALS", "TEXT"},
+			{"CONTENT_TYPE", "VARCHAR(255)"},
+			{"CONNECT_TIMEOUT", "DOUBLE"},
+			{"READ_TIMEOUT", "DOUBLE"},
+			{"TLS_VERIFY", "VARCHAR(8)"},
+			{"CA_CERT", "TEXT"},
+		}
+		for _, c := range columns {
+			err := addColumn(db, "remote_interceptor", c.Column, c.Definition)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	// TLS certificates of remote interceptors used not to be verified, keep
+	// it that way for those created before it was, or those calling self
+	// signed endpoints would start to fail.
+	{"ri_tls_verify_off", func(db *sql.DB) error {
+		_, err := gosqljson.ExecDb(db, `UPDATE remote_interceptor SET TLS_VERIFY='0' WHERE TLS_VERIFY IS NULL OR TLS_VERIFY=''`)
+		if err != nil {
+			return err
+		}
+		return loadAllRemoteInterceptor()
+	}},
+	// push notifications are delivered in the order of SEQ
+	{"push_notification_seq", func(db *sql.DB) error {
+		exists, err := columnExists(db, "push_notification", "SEQ")
+		if err != nil || exists {
+			return err
+		}
+		_, err = gosqljson.ExecDb(db, `ALTER TABLE push_notification ADD COLUMN SEQ BIGINT NOT NULL AUTO_INCREMENT UNIQUE`)
+		return err
+	}},
+	// when a notification was claimed for delivery
+	{"push_notification_claim", func(db *sql.DB) error {
+		return addColumn(db, "push_notification", "CLAIM_TIME", "DATETIME")
+	}},
+	// circuit breakers of remote interceptors
+	{"ri_breaker", func(db *sql.DB) error {
+		columns := []struct{ Column, Definition string }{
+			{"FAILURE_THRESHOLD", "INT"},
+			{"COOL_DOWN", "DOUBLE"},
+			{"FAIL_POLICY", "VARCHAR(16)"},
+		}
+		for _, c := range columns {
+			err := addColumn(db, "remote_interceptor", c.Column, c.Definition)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	// ordering and switching off of remote interceptors
+	{"ri_priority", func(db *sql.DB) error {
+		err := addColumn(db, "remote_interceptor", "PRIORITY", "INT")
+		if err != nil {
+			return err
+		}
+		return addColumn(db, "remote_interceptor", "ENABLED", "VARCHAR(8)")
+	}},
+	// the log of push notification attempts
+	{"push_notification_attempt", func(db *sql.DB) error {
+		_, err := gosqljson.ExecDb(db, createPushAttemptTable)
+		return err
+	}},
+	// the outbox of projects created before it was part of a project
+	{"project_outbox", func(db *sql.DB) error {
+		projects, err := gosqljson.QueryDbToMap(db, "upper", `SELECT ID,PROJECT_KEY FROM project`)
+		if err != nil {
+			return err
+		}
+		for _, project := range projects {
+			projectDb, err := projectConn(project["ID"])
+			if err == nil {
+				err = ensureOutboxTable(projectDb, "nd_"+project["PROJECT_KEY"])
+			}
+			if err != nil {
+				// saving the project creates it as well
+				fmt.Println(project["ID"], err)
+			}
+		}
+		return nil
+	}},
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	data, err := gosqljson.QueryDbToMap(db, "upper", `SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND COLUMN_NAME=?`, table, column)
+	if err != nil {
+		return false, err
+	}
+	return len(data) > 0, nil
+}
+
+func indexExists(db *sql.DB, table, index string) (bool, error) {
+	data, err := gosqljson.QueryDbToMap(db, "upper", `SELECT INDEX_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND INDEX_NAME=?`, table, index)
+	if err != nil {
+		return false, err
+	}
+	return len(data) > 0, nil
+}
+
+// addColumn adds a column to a table unless it is already there.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = gosqljson.ExecDb(db, fmt.Sprint("ALTER TABLE ", table, " ADD COLUMN ", column, " ", definition))
+	return err
+}
+
+// addQueryField adds a column of the query definition to queries and their
+// versions.
+func addQueryField(db *sql.DB, column, definition string) error {
+	err := addColumn(db, "query", column, definition)
+	if err != nil {
+		return err
+	}
+	return addColumn(db, "query_version", column, definition)
+}
+
+func migrate(db *sql.DB) error {
+	_, err := gosqljson.ExecDb(db, createMigrationTable)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK('nd_migration',?)", migrationLockTimeout).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return errors.New("Failed to lock migrations.")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK('nd_migration')")
+
+	applied, err := gosqljson.QueryDbToMap(db, "upper", "SELECT ID FROM nd_migration")
+	if err != nil {
+		return err
+	}
+	done := map[string]bool{}
+	for _, row := range applied {
+		done[row["ID"]] = true
+	}
+	for _, m := range migrations {
+		if done[m.Id] {
+			continue
+		}
+		err = m.Migrate(db)
+		if err != nil {
+			return errors.New(fmt.Sprint("Migration ", m.Id, " failed: ", err.Error()))
+		}
+		_, err = gosqljson.ExecDb(db, "INSERT INTO nd_migration(ID,CREATE_TIME) VALUES(?,?)", m.Id, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		fmt.Println("Migrated", m.Id)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// nd_data_multi
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/elgs/gosqljson"
+)
+
+// QueryMulti runs a stored query whose MODE is multi. All statements of its
+// script run in one transaction, and the result has one entry per
+// statement: the rows of reads as data, and rows_affected and
+// last_insert_id of writes. The Exec interceptors apply, with the row count
+// standing in for rows affected of reads.
+func (this *NdDataOperator) QueryMulti(tableId string, params []interface{}, queryParams []string, context map[string]interface{}) ([]map[string]interface{}, error) {
+	batchParams := [][]interface{}{params}
+	query, tx, err := this.prepareExec(tableId, &batchParams, queryParams, context)
+	if tx == nil {
+		if err == nil {
+			err = errors.New("Query rejected.")
+		}
+		return nil, err
+	}
+	if query["mode"] != "multi" {
+		tx.Rollback()
+		return nil, errors.New("Not a multi statement query.")
+	}
+	tableId = query["name"]
+	scripts := query["script"]
+
+	statements, err := prepareBatch(query, &scripts, queryParams, batchParams, buildContextVars(context))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	c, _ := context["case"].(string)
+	results := []map[string]interface{}{}
+	rowsAffectedArray := [][]int64{}
+	for _, statements1 := range statements {
+		rowsAffectedArray1 := []int64{}
+		for _, statement := range statements1 {
+			result, rowsAffected, err := execMultiStatement(tx.Tx, c, statement)
+			if err != nil {
+				tx.Rollback()
+				return nil, tx.queryError(err)
+			}
+			results = append(results, result)
+			rowsAffectedArray1 = append(rowsAffectedArray1, rowsAffected)
+		}
+		rowsAffectedArray = append(rowsAffectedArray, rowsAffectedArray1)
+	}
+	recordQueryCacheWrites(tx.Tx, context, scripts)
+
+	err = afterExec(tableId, scripts, &batchParams, queryParams, tx.Tx, context, rowsAffectedArray)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = commitExec(tx, context)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func execMultiStatement(tx *sql.Tx, c string, statement *SqlStatement) (map[string]interface{}, int64, error) {
+	if isReadStatement(statement.Sql) {
+		m, err := gosqljson.QueryTxToMap(tx, c, statement.Sql, statement.Args...)
+		if err != nil {
+			fmt.Println(err)
+			return nil, 0, err
+		}
+		return map[string]interface{}{"data": m}, int64(len(m)), nil
+	}
+	result, err := tx.Exec(statement.Sql, statement.Args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, 0, err
+	}
+	lastInsertId, err := result.LastInsertId()
+	if err != nil {
+		return nil, 0, err
+	}
+	return map[string]interface{}{
+		"rows_affected":  rowsAffected,
+		"last_insert_id": lastInsertId,
+	}, rowsAffected, nil
+}
+
+// isReadStatement tells whether a statement returns rows.
+func isReadStatement(s string) bool {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(strings.TrimLeft(fields[0], "(")) {
+	case "SELECT", "SHOW", "DESC", "DESCRIBE", "EXPLAIN", "WITH":
+		return true
+	}
+	return false
+}
@@ -2,9 +2,13 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/elgs/gorest2"
 	"github.com/elgs/gosplitargs"
@@ -12,9 +16,20 @@ import (
 )
 
 type NdDataOperator struct {
+	// queryTimeout is the QUERY_TIMEOUT of the project, changed while
+	// requests read it, so it is only accessed atomically.
+	queryTimeout int64
 	*gorest2.MySqlDataOperator
 }
 
+func (this *NdDataOperator) QueryTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.queryTimeout))
+}
+
+func (this *NdDataOperator) SetQueryTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&this.queryTimeout, int64(timeout))
+}
+
 func NewDbo(ds, dbType string) gorest2.DataOperator {
 	return &NdDataOperator{
 		MySqlDataOperator: &gorest2.MySqlDataOperator{
@@ -25,6 +40,16 @@ func NewDbo(ds, dbType string) gorest2.DataOperator {
 	}
 }
 
+// queryFields are the columns of a query definition, kept per version in
+// query_version and exposed in lower case by loadQuery.
+var queryFields = []string{"SCRIPT", "PARAMS", "IDENTIFIERS", "CURSOR", "CACHE_TTL", "CACHE_DEPENDS", "MODE", "ISOLATION_LEVEL", "READ_ONLY", "TIMEOUT", "SHAPE"}
+
+var errQueryNotFound = errors.New("Query not found.")
+
+// loadQuery resolves the active version of a stored query, or a pinned one
+// when the name is given as name@version, with its includes expanded. The
+// returned name never carries the pin, so interceptors and token targets
+// keep matching the plain name.
 func loadQuery(projectId, queryName string) (map[string]string, error) {
 	key := fmt.Sprint("query:", projectId, ":", queryName)
 	queryMap := gorest2.RedisLocal.HGetAllMap(key).Val()
@@ -32,100 +57,214 @@ func loadQuery(projectId, queryName string) (map[string]string, error) {
 		return queryMap, nil
 	}
 
+	queryMap, err := loadQueryDefinition(projectId, queryName)
+	if err != nil {
+		return nil, err
+	}
+	name := queryMap["name"]
+	err = composeQuery(projectId, queryMap, []string{name}, func(included string) {
+		gorest2.RedisMaster.SAdd(queryIncludersKey(projectId, included), key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := []string{}
+	for _, field := range queryFields {
+		pairs = append(pairs, strings.ToLower(field), queryMap[strings.ToLower(field)])
+	}
+	err = gorest2.RedisMaster.HMSet(key, "name", name, append([]string{"version", queryMap["version"]}, pairs...)...).Err()
+	return queryMap, nil
+}
+
+// loadQueryDefinition reads a query definition as stored, bypassing the
+// cache and without expanding includes.
+func loadQueryDefinition(projectId, queryName string) (map[string]string, error) {
+	name, version := splitQueryVersion(queryName)
 	defaultDbo := gorest2.GetDbo("default")
 	defaultDb, err := defaultDbo.GetConn()
 	if err != nil {
 		return nil, err
 	}
 	queryData, err := gosqljson.QueryDbToMap(defaultDb, "upper",
-		"SELECT * FROM query WHERE PROJECT_ID=? AND NAME=?", projectId, queryName)
+		"SELECT * FROM query WHERE PROJECT_ID=? AND NAME=?", projectId, name)
 	if err != nil {
 		return nil, err
 	}
 	if len(queryData) == 0 {
-		return nil, errors.New("Query not found.")
+		return nil, errQueryNotFound
+	}
+	queryRow := queryData[0]
+	if version == "" {
+		version = queryRow["ACTIVE_VERSION"]
+	}
+	if version != "" && version != "0" {
+		versionData, err := gosqljson.QueryDbToMap(defaultDb, "upper",
+			"SELECT * FROM query_version WHERE QUERY_ID=? AND VERSION=?", queryRow["ID"], version)
+		if err != nil {
+			return nil, err
+		}
+		if len(versionData) == 0 {
+			return nil, errors.New("Query version not found.")
+		}
+		queryRow = versionData[0]
 	}
 
-	err = gorest2.RedisMaster.HMSet(key, "name", queryData[0]["NAME"], "script", queryData[0]["SCRIPT"]).Err()
-	return queryData[0], nil
+	queryMap := map[string]string{
+		"name":    name,
+		"version": version,
+	}
+	for _, field := range queryFields {
+		queryMap[strings.ToLower(field)] = queryRow[field]
+	}
+	return queryMap, nil
 }
 
-func (this *NdDataOperator) QueryMap(tableId string, params []interface{}, queryParams []string, context map[string]interface{}) ([]map[string]string, error) {
+// preparedQuery is a stored query that went through the Before*
+// interceptors, with its params bound and ready to be sent to the database.
+type preparedQuery struct {
+	Query     map[string]string
+	Cache     *queryCachePolicy
+	TxOptions *sql.TxOptions
+	Ctx       context.Context
+	Timeout   time.Duration
+	Tx        *queryTx
+	TableId   string
+	Script    string
+	Params    []interface{}
+	Args      []interface{}
+	Db        *sql.DB
+}
+
+// prepareQuery runs the read pipeline of QueryMap and QueryArray up to the
+// point where the script is sent to the database. A nil preparedQuery with a
+// nil error means an interceptor silently rejected the request.
+func (this *NdDataOperator) prepareQuery(tableId string, params []interface{}, queryParams []string, context map[string]interface{}, array bool) (*preparedQuery, error) {
 	projectId := context["app_id"].(string)
 	query, err := loadQuery(projectId, tableId)
 	if err != nil {
 		return nil, err
 	}
+	tableId = query["name"]
 
-	ret := make([]map[string]string, 0)
+	cache, err := parseQueryCachePolicy(query["cache_ttl"], query["cache_depends"])
+	if err != nil {
+		return nil, err
+	}
+	txOptions, err := parseQueryTxOptions(query["isolation_level"], query["read_only"])
+	if err != nil {
+		return nil, err
+	}
 
-	script := query["script"]
+	script, params, err := bindQueryParams(query, query["script"], params)
+	if err != nil {
+		return nil, err
+	}
 
 	count, err := gosplitargs.CountSeparators(script, "\\?")
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
 	if count > len(params) {
 		return nil, errors.New(fmt.Sprintln("Incorrect param count. Expected: ", count, " actual: ", len(params)))
 	}
 
-	for i, v := range queryParams {
-		script = strings.Replace(script, fmt.Sprint("$", i), v, -1)
+	script, err = bindQueryIdentifiers(query, script, queryParams)
+	if err != nil {
+		return nil, err
 	}
 
 	db, err := this.GetConn()
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
 
 	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
 	for _, k := range globalSortedKeys {
 		globalDataInterceptor := globalDataInterceptors[k]
-		ctn, err := globalDataInterceptor.BeforeQueryMap(tableId, script, &params, db, context)
+		var ctn bool
+		if array {
+			ctn, err = globalDataInterceptor.BeforeQueryArray(tableId, script, &params, db, context)
+		} else {
+			ctn, err = globalDataInterceptor.BeforeQueryMap(tableId, script, &params, db, context)
+		}
 		if !ctn {
-			return ret, err
+			return nil, err
 		}
 	}
 	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
 	for _, k := range sortedKeys {
 		dataInterceptor := dataInterceptors[k]
 		if dataInterceptor != nil {
-			ctn, err := dataInterceptor.BeforeQueryMap(tableId, script, &params, db, context)
+			var ctn bool
+			if array {
+				ctn, err = dataInterceptor.BeforeQueryArray(tableId, script, &params, db, context)
+			} else {
+				ctn, err = dataInterceptor.BeforeQueryMap(tableId, script, &params, db, context)
+			}
 			if !ctn {
-				return ret, err
+				return nil, err
 			}
 		}
 	}
 
-	if clientIp, ok := context["client_ip"].(string); ok {
-		script = strings.Replace(script, "__ip__", clientIp, -1)
-	}
-	if tokenUserId, ok := context["token_user_id"].(string); ok {
-		script = strings.Replace(script, "__token_user_id__", tokenUserId, -1)
-	}
-	if tokenUserCode, ok := context["token_user_code"].(string); ok {
-		script = strings.Replace(script, "__token_user_code__", tokenUserCode, -1)
-	}
-	if loginUserId, ok := context["user_id"].(string); ok {
-		script = strings.Replace(script, "__login_user_id__", loginUserId, -1)
+	args := params[:count]
+	script, args, err = bindQueryValues(query, script, args, queryParams)
+	if err != nil {
+		return nil, err
 	}
-	if loginUserCode, ok := context["email"].(string); ok {
-		script = strings.Replace(script, "__login_user_code__", loginUserCode, -1)
+	script, args = bindContextVars(script, args, buildContextVars(context))
+	batchTx, _ := context["batch_tx"].(*queryTx)
+
+	return &preparedQuery{
+		Query:     query,
+		Cache:     cache,
+		TxOptions: txOptions,
+		Ctx:       requestContext(context),
+		Timeout:   queryTimeout(query, this),
+		Tx:        batchTx,
+		TableId:   tableId,
+		Script:    script,
+		Params:    params,
+		Args:      args,
+		Db:        db,
+	}, nil
+}
+
+func (this *NdDataOperator) QueryMap(tableId string, params []interface{}, queryParams []string, context map[string]interface{}) ([]map[string]string, error) {
+	ret := make([]map[string]string, 0)
+
+	pq, err := this.prepareQuery(tableId, params, queryParams, context, false)
+	if pq == nil {
+		return ret, err
 	}
+	tableId, script, params, db := pq.TableId, pq.Script, pq.Params, pq.Db
 
-	c := context["case"].(string)
-	m, err := gosqljson.QueryDbToMap(db, c, script, params[:count]...)
+	cacheKey, err := queryCacheKey(pq, context, false)
 	if err != nil {
-		fmt.Println(err)
 		return ret, err
 	}
+	var m []map[string]string
+	if cacheKey == "" || !getCachedQuery(cacheKey, &m) {
+		c := context["case"].(string)
+		m, err = pq.queryMap(c, script, pq.Args...)
+		if err != nil {
+			fmt.Println(err)
+			return ret, err
+		}
+		if cacheKey != "" {
+			setCachedQuery(cacheKey, pq.Cache, m)
+		}
+	}
 
+	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
 	for _, k := range sortedKeys {
 		dataInterceptor := dataInterceptors[k]
 		if dataInterceptor != nil {
 			dataInterceptor.AfterQueryMap(tableId, script, &params, db, context, &m)
 		}
 	}
+	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
 	for _, k := range globalSortedKeys {
 		globalDataInterceptor := globalDataInterceptors[k]
 		globalDataInterceptor.AfterQueryMap(tableId, script, &params, db, context, &m)
@@ -134,78 +273,45 @@ func (this *NdDataOperator) QueryMap(tableId string, params []interface{}, query
 	return m, err
 }
 func (this *NdDataOperator) QueryArray(tableId string, params []interface{}, queryParams []string, context map[string]interface{}) ([]string, [][]string, error) {
-	projectId := context["app_id"].(string)
-	query, err := loadQuery(projectId, tableId)
-	if err != nil {
+	pq, err := this.prepareQuery(tableId, params, queryParams, context, true)
+	if pq == nil {
 		return nil, nil, err
 	}
+	tableId, script, params, db := pq.TableId, pq.Script, pq.Params, pq.Db
 
-	script := query["script"]
-	count, err := gosplitargs.CountSeparators(script, "\\?")
-	if err != nil {
-		return nil, nil, err
-	}
-	if count > len(params) {
-		return nil, nil, errors.New(fmt.Sprintln("Incorrect param count. Expected: ", count, " actual: ", len(params)))
-	}
-
-	for i, v := range queryParams {
-		script = strings.Replace(script, fmt.Sprint("$", i), v, -1)
-	}
-
-	db, err := this.GetConn()
+	cacheKey, err := queryCacheKey(pq, context, true)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
-	for _, k := range globalSortedKeys {
-		globalDataInterceptor := globalDataInterceptors[k]
-		ctn, err := globalDataInterceptor.BeforeQueryArray(tableId, script, &params, db, context)
-		if !ctn {
+	var h []string
+	var a [][]string
+	cached := struct {
+		H []string
+		A [][]string
+	}{}
+	if cacheKey != "" && getCachedQuery(cacheKey, &cached) {
+		h, a = cached.H, cached.A
+	} else {
+		c := context["case"].(string)
+		h, a, err = pq.queryArray(c, script, pq.Args...)
+		if err != nil {
+			fmt.Println(err)
 			return nil, nil, err
 		}
-	}
-	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
-	for _, k := range sortedKeys {
-		dataInterceptor := dataInterceptors[k]
-		if dataInterceptor != nil {
-			ctn, err := dataInterceptor.BeforeQueryArray(tableId, script, &params, db, context)
-			if !ctn {
-				return nil, nil, err
-			}
+		if cacheKey != "" {
+			cached.H, cached.A = h, a
+			setCachedQuery(cacheKey, pq.Cache, cached)
 		}
 	}
 
-	if clientIp, ok := context["client_ip"].(string); ok {
-		script = strings.Replace(script, "__ip__", clientIp, -1)
-	}
-	if tokenUserId, ok := context["token_user_id"].(string); ok {
-		script = strings.Replace(script, "__token_user_id__", tokenUserId, -1)
-	}
-	if tokenUserCode, ok := context["token_user_code"].(string); ok {
-		script = strings.Replace(script, "__token_user_code__", tokenUserCode, -1)
-	}
-	if loginUserId, ok := context["user_id"].(string); ok {
-		script = strings.Replace(script, "__login_user_id__", loginUserId, -1)
-	}
-	if loginUserCode, ok := context["email"].(string); ok {
-		script = strings.Replace(script, "__login_user_code__", loginUserCode, -1)
-	}
-
-	c := context["case"].(string)
-	h, a, err := gosqljson.QueryDbToArray(db, c, script, params[:count]...)
-	if err != nil {
-		fmt.Println(err)
-		return nil, nil, err
-	}
-
+	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
 	for _, k := range sortedKeys {
 		dataInterceptor := dataInterceptors[k]
 		if dataInterceptor != nil {
 			dataInterceptor.AfterQueryArray(tableId, script, &params, db, context, &h, &a)
 		}
 	}
+	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
 	for _, k := range globalSortedKeys {
 		globalDataInterceptor := globalDataInterceptors[k]
 		globalDataInterceptor.AfterQueryArray(tableId, script, &params, db, context, &h, &a)
@@ -213,73 +319,222 @@ func (this *NdDataOperator) QueryArray(tableId string, params []interface{}, que
 
 	return h, a, err
 }
-func (this *NdDataOperator) Exec(tableId string, params [][]interface{}, queryParams []string, context map[string]interface{}) ([][]int64, error) {
+
+// prepareExec loads a stored query, begins its transaction and runs the
+// BeforeExec interceptors. The caller owns the returned transaction; a nil
+// transaction means the request was rejected.
+func (this *NdDataOperator) prepareExec(tableId string, params *[][]interface{}, queryParams []string, context map[string]interface{}) (map[string]string, *queryTx, error) {
 	projectId := context["app_id"].(string)
 
 	query, err := loadQuery(projectId, tableId)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	tableId = query["name"]
 	scripts := query["script"]
 
 	db, err := this.GetConn()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	tx, err := db.Begin()
+	txOptions, err := parseQueryTxOptions(query["isolation_level"], query["read_only"])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	var tx *queryTx
+	if batchTx, ok := context["batch_tx"].(*queryTx); ok {
+		tx = batchTx.share()
+	} else {
+		tx, err = beginGuardedTx(requestContext(context), queryTimeout(query, this), db, txOptions)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
 	for _, k := range globalSortedKeys {
 		globalDataInterceptor := globalDataInterceptors[k]
-		ctn, err := globalDataInterceptor.BeforeExec(tableId, scripts, &params, queryParams, tx, context)
+		ctn, err := globalDataInterceptor.BeforeExec(tableId, scripts, params, queryParams, tx.Tx, context)
 		if !ctn {
 			tx.Rollback()
-			return nil, err
+			return nil, nil, err
 		}
 	}
 	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
 	for _, k := range sortedKeys {
 		dataInterceptor := dataInterceptors[k]
 		if dataInterceptor != nil {
-			ctn, err := dataInterceptor.BeforeExec(tableId, scripts, &params, queryParams, tx, context)
+			ctn, err := dataInterceptor.BeforeExec(tableId, scripts, params, queryParams, tx.Tx, context)
 			if !ctn {
 				tx.Rollback()
-				return nil, err
+				return nil, nil, err
 			}
 		}
 	}
+	return query, tx, nil
+}
+
+func (this *NdDataOperator) Exec(tableId string, params [][]interface{}, queryParams []string, context map[string]interface{}) ([][]int64, error) {
+	results, err := this.ExecResults(tableId, params, queryParams, context)
+	if results == nil {
+		return nil, err
+	}
+	return rowsAffectedOf(results), err
+}
 
-	replaceContext := buildReplaceContext(context)
-	rowsAffectedArray, err := batchExecuteTx(tx, nil, &scripts, queryParams, params, replaceContext)
+// ExecResults runs a writing stored query like Exec, but returns the last
+// insert id of every statement besides its rows affected. With fetch_inserted
+// set in the context, the inserted rows are read back in the same
+// transaction. The results are put in the context as exec_results for the
+// AfterExec interceptors.
+func (this *NdDataOperator) ExecResults(tableId string, params [][]interface{}, queryParams []string, context map[string]interface{}) ([][]*ExecResult, error) {
+	query, tx, err := this.prepareExec(tableId, &params, queryParams, context)
+	if tx == nil {
+		return nil, err
+	}
+	tableId = query["name"]
+	scripts := query["script"]
+
+	contextVars := buildContextVars(context)
+	results, err := batchExecuteResultsTx(tx.Tx, nil, query, &scripts, queryParams, params, contextVars)
 
+	if err != nil {
+		tx.Rollback()
+		return nil, tx.queryError(err)
+	}
+	recordQueryCacheWrites(tx.Tx, context, scripts)
+
+	if fetch, _ := context["fetch_inserted"].(bool); fetch {
+		c, _ := context["case"].(string)
+		err = fetchInsertedRows(tx.Tx, c, results)
+		if err != nil {
+			tx.Rollback()
+			return nil, tx.queryError(err)
+		}
+	}
+	context["exec_results"] = results
+
+	err = afterExec(tableId, scripts, &params, queryParams, tx.Tx, context, rowsAffectedOf(results))
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
+	err = commitExec(tx, context)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// afterExec runs the AfterExec interceptors of a stored query in the
+// transaction it was executed in.
+func afterExec(tableId string, scripts string, params *[][]interface{}, queryParams []string, tx *sql.Tx, context map[string]interface{}, rowsAffectedArray [][]int64) error {
+	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
 	for _, k := range sortedKeys {
 		dataInterceptor := dataInterceptors[k]
 		if dataInterceptor != nil {
-			err := dataInterceptor.AfterExec(tableId, scripts, &params, queryParams, tx, context, rowsAffectedArray)
+			err := dataInterceptor.AfterExec(tableId, scripts, params, queryParams, tx, context, rowsAffectedArray)
 			if err != nil {
-				tx.Rollback()
-				return nil, err
+				return err
 			}
 		}
 	}
+	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
 	for _, k := range globalSortedKeys {
 		globalDataInterceptor := globalDataInterceptors[k]
-		err := globalDataInterceptor.AfterExec(tableId, scripts, &params, queryParams, tx, context, rowsAffectedArray)
+		err := globalDataInterceptor.AfterExec(tableId, scripts, params, queryParams, tx, context, rowsAffectedArray)
 		if err != nil {
-			tx.Rollback()
-			return nil, err
+			return err
+		}
+	}
+	return nil
+}
+
+// commitExec commits the transaction of a stored query, drops the cached
+// results of the tables it wrote to and relays the events of its outbox.
+func commitExec(tx *queryTx, context map[string]interface{}) error {
+	written, _ := context["written_tables"].([]string)
+	outbox, _ := context["outbox"].([]string)
+	if tx.parent != nil {
+		tx.parent.written = append(tx.parent.written, written...)
+		tx.parent.outbox = append(tx.parent.outbox, outbox...)
+		return nil
+	}
+	err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	invalidateQueryCache(context["app_id"].(string), written)
+	relayOutboxAfterCommit(context["app_id"].(string), outbox)
+	return nil
+}
+
+// isDryRun tells whether the request is a dry run. The remote and local
+// interceptors skip dry runs, the token and ACL interceptors still apply.
+func isDryRun(context map[string]interface{}) bool {
+	dryRun, _ := context["dry_run"].(bool)
+	return dryRun
+}
+
+// DryRunQuery runs a stored query through the Before* interceptors and
+// returns the final SQL, its bound params and the EXPLAIN output instead of
+// its result. The EXPLAIN runs the way the query would, with its timeout
+// and transaction options, and is canceled with the request.
+func (this *NdDataOperator) DryRunQuery(tableId string, params []interface{}, queryParams []string, context map[string]interface{}) (map[string]interface{}, error) {
+	pq, err := this.prepareQuery(tableId, params, queryParams, context, false)
+	if pq == nil {
+		if err == nil {
+			err = errors.New("Query rejected.")
 		}
+		return nil, err
 	}
+	explain, err := pq.queryMap("", "EXPLAIN "+pq.Script, pq.Args...)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"sql":     pq.Script,
+		"params":  pq.Args,
+		"explain": explain,
+	}, nil
+}
 
-	tx.Commit()
+// DryRunExec does the same for a writing stored query. Statements are only
+// explained, and the transaction the Before* interceptors ran in is rolled
+// back.
+func (this *NdDataOperator) DryRunExec(tableId string, params [][]interface{}, queryParams []string, context map[string]interface{}) ([][]map[string]interface{}, error) {
+	query, tx, err := this.prepareExec(tableId, &params, queryParams, context)
+	if tx == nil {
+		if err == nil {
+			err = errors.New("Query rejected.")
+		}
+		return nil, err
+	}
+	defer tx.Rollback()
+	scripts := query["script"]
 
-	return rowsAffectedArray, err
+	statements, err := prepareBatch(query, &scripts, queryParams, params, buildContextVars(context))
+	if err != nil {
+		return nil, err
+	}
+	ret := [][]map[string]interface{}{}
+	for _, statements1 := range statements {
+		ret1 := []map[string]interface{}{}
+		for _, statement := range statements1 {
+			m := map[string]interface{}{
+				"sql":    statement.Sql,
+				"params": statement.Args,
+			}
+			explain, err := gosqljson.QueryTxToMap(tx.Tx, "", "EXPLAIN "+statement.Sql, statement.Args...)
+			if err != nil {
+				m["explain_err"] = err.Error()
+			} else {
+				m["explain"] = explain
+			}
+			ret1 = append(ret1, m)
+		}
+		ret = append(ret, ret1)
+	}
+	return ret, nil
 }
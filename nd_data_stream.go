@@ -0,0 +1,201 @@
+// nd_data_stream
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elgs/gorest2"
+)
+
+// RowInterceptor is implemented by data interceptors that want to see
+// streamed query results row by row. Returning false drops the row. The
+// AfterQueryMap hooks are not called for streamed results, targets whose
+// hooks would do something are not streamed.
+type RowInterceptor interface {
+	AfterQueryRow(resourceId string, context map[string]interface{}, row map[string]string) (bool, error)
+}
+
+// AfterQueryInterceptor is implemented by data interceptors whose
+// AfterQueryMap hook may do something for a target, like the remote and
+// local interceptors. Such a target is not streamed, as streaming would
+// bypass the hook.
+type AfterQueryInterceptor interface {
+	HasAfterQuery(resourceId string, context map[string]interface{}) bool
+}
+
+const streamFlushRows = 100
+
+// QueryStream runs a stored query like QueryMap, but writes the rows to w as
+// they are read from the database instead of materializing the result. The
+// format is either ndjson, one row per line, or json, a {"data":[...]}
+// object. Errors are written to w as well, as a final {"err":...} line or
+// as the err field of the json object.
+func (this *NdDataOperator) QueryStream(tableId string, params []interface{}, queryParams []string, context map[string]interface{}, w io.Writer, format string) error {
+	// checked before the before hooks run, against the name the hooks of
+	// a versioned query are registered under
+	queryName, _ := splitQueryVersion(tableId)
+	if hasAfterQuery(queryName, context) {
+		err := errors.New("Query cannot be streamed, it has after interceptors.")
+		writeStreamError(w, format, err)
+		return err
+	}
+	pq, err := this.prepareQuery(tableId, params, queryParams, context, false)
+	if pq == nil {
+		if err == nil {
+			err = errors.New("Query rejected.")
+		}
+		writeStreamError(w, format, err)
+		return err
+	}
+
+	rowInterceptors := []RowInterceptor{}
+	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(pq.TableId)
+	for _, k := range sortedKeys {
+		if rowInterceptor, ok := dataInterceptors[k].(RowInterceptor); ok {
+			rowInterceptors = append(rowInterceptors, rowInterceptor)
+		}
+	}
+	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
+	for _, k := range globalSortedKeys {
+		if rowInterceptor, ok := globalDataInterceptors[k].(RowInterceptor); ok {
+			rowInterceptors = append(rowInterceptors, rowInterceptor)
+		}
+	}
+
+	var rows *sql.Rows
+	var tx *queryTx
+	if !pq.guarded() {
+		rows, err = pq.Db.Query(pq.Script, pq.Args...)
+	} else {
+		tx, err = beginGuardedTx(pq.Ctx, pq.Timeout, pq.Db, pq.TxOptions)
+		if err != nil {
+			writeStreamError(w, format, err)
+			return err
+		}
+		defer tx.Rollback()
+		rows, err = tx.Query(pq.Script, pq.Args...)
+		err = tx.queryError(err)
+	}
+	if err != nil {
+		writeStreamError(w, format, err)
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		writeStreamError(w, format, err)
+		return err
+	}
+	c, _ := context["case"].(string)
+	for i, column := range columns {
+		if c == "upper" {
+			columns[i] = strings.ToUpper(column)
+		} else if c == "lower" {
+			columns[i] = strings.ToLower(column)
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	values := make([]sql.RawBytes, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	if format == "json" {
+		io.WriteString(w, `{"data":[`)
+	}
+	count := 0
+	for rows.Next() {
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			break
+		}
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			row[column] = string(values[i])
+		}
+		keep := true
+		for _, rowInterceptor := range rowInterceptors {
+			keep, err = rowInterceptor.AfterQueryRow(pq.TableId, context, row)
+			if !keep || err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		if !keep {
+			continue
+		}
+		var jsonData []byte
+		jsonData, err = json.Marshal(row)
+		if err != nil {
+			break
+		}
+		if format == "json" {
+			if count > 0 {
+				io.WriteString(w, ",")
+			}
+			w.Write(jsonData)
+		} else {
+			w.Write(jsonData)
+			io.WriteString(w, "\n")
+		}
+		count++
+		if flusher != nil && count%streamFlushRows == 0 {
+			flusher.Flush()
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if tx != nil {
+		err = tx.queryError(err)
+	}
+
+	if format == "json" {
+		io.WriteString(w, "]")
+		if err != nil {
+			errData, _ := json.Marshal(err.Error())
+			io.WriteString(w, `,"err":`)
+			w.Write(errData)
+		}
+		io.WriteString(w, "}")
+	} else if err != nil {
+		writeStreamError(w, format, err)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return err
+}
+
+func hasAfterQuery(tableId string, context map[string]interface{}) bool {
+	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(tableId)
+	for _, k := range sortedKeys {
+		if afterQuery, ok := dataInterceptors[k].(AfterQueryInterceptor); ok && afterQuery.HasAfterQuery(tableId, context) {
+			return true
+		}
+	}
+	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
+	for _, k := range globalSortedKeys {
+		if afterQuery, ok := globalDataInterceptors[k].(AfterQueryInterceptor); ok && afterQuery.HasAfterQuery(tableId, context) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeStreamError(w io.Writer, format string, err error) {
+	errData, _ := json.Marshal(map[string]string{"err": err.Error()})
+	w.Write(errData)
+	if format != "json" {
+		io.WriteString(w, "\n")
+	}
+}
@@ -2,7 +2,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -15,21 +14,37 @@ import (
 	"github.com/elgs/gosqljson"
 )
 
-func httpRequest(url string, method string, data string, maxReadLimit int64) ([]byte, int, error) {
+func httpRequest(url string, method string, data string, maxReadLimit int64, opts *httpOptions) ([]byte, int, error) {
 	defer func() {
 		if err := recover(); err != nil {
 			fmt.Println(err)
 		}
 	}()
 
+	if opts == nil {
+		opts = &httpOptions{
+			ConnectTimeout: defaultRiConnectTimeout,
+			ReadTimeout:    defaultRiReadTimeout,
+		}
+	}
+	err := egress.checkURL(url)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial:                  egress.dialer(opts.ConnectTimeout),
+		TLSClientConfig:       opts.TLSConfig,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.ReadTimeout,
 	}
-	client := &http.Client{Transport: tr}
+	client := &http.Client{Transport: tr, Timeout: opts.ConnectTimeout + opts.ReadTimeout}
 	req, err := http.NewRequest(method, url, strings.NewReader(data))
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
+	for k, v := range opts.Header {
+		req.Header[k] = v
+	}
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -50,94 +65,200 @@ func httpRequest(url string, method string, data string, maxReadLimit int64) ([]
 	return result, res.StatusCode, err
 }
 
-func batchExecuteTx(tx *sql.Tx, db *sql.DB, script *string, scriptParams []string, params [][]interface{}, replaceContext map[string]string) ([][]int64, error) {
-
-	rowsAffectedArray := [][]int64{}
-
-	innerTrans := false
-	if tx == nil {
-		var err error
-		tx, err = db.Begin()
-		innerTrans = true
-		if err != nil {
-			return rowsAffectedArray, err
-		}
-	}
-
-	for i, v := range scriptParams {
-		*script = strings.Replace(*script, fmt.Sprint("$", i), v, -1)
-	}
+// SqlStatement is one statement of a batch, ready to be sent to the database.
+type SqlStatement struct {
+	Sql  string        `json:"sql"`
+	Args []interface{} `json:"params"`
+}
 
-	for k, v := range replaceContext {
-		*script = strings.Replace(*script, k, v, -1)
+// prepareBatch substitutes the query params and the context into script and
+// binds every row of params to its statements, without touching the database.
+func prepareBatch(query map[string]string, script *string, scriptParams []string, params [][]interface{}, contextVars map[string]interface{}) ([][]*SqlStatement, error) {
+	var err error
+	*script, err = bindQueryIdentifiers(query, *script, scriptParams)
+	if err != nil {
+		return nil, err
 	}
 
 	scriptsArray, err := gosplitargs.SplitArgs(*script, ";", true)
 	if err != nil {
-		if innerTrans {
-			tx.Rollback()
-		}
-		return rowsAffectedArray, err
+		return nil, err
+	}
+	paramDefs, err := parseQueryParams(query["params"])
+	if err != nil {
+		return nil, err
 	}
+
+	statements := [][]*SqlStatement{}
 	for _, params1 := range params {
 		totalCount := 0
-		rowsAffectedArray1 := []int64{}
+		statements1 := []*SqlStatement{}
+		var paramValues map[string]interface{}
+		if len(paramDefs) > 0 {
+			paramValues, err = resolveQueryParams(paramDefs, params1)
+			if err != nil {
+				return nil, err
+			}
+		}
 		for _, s := range scriptsArray {
 			sqlNormalize(&s)
 			if len(s) == 0 {
 				continue
 			}
+			if len(paramDefs) > 0 {
+				s, args, err := bindNamedParams(s, paramDefs, paramValues)
+				if err != nil {
+					return nil, err
+				}
+				s, args, err = bindQueryValues(query, s, args, scriptParams)
+				if err != nil {
+					return nil, err
+				}
+				s, args = bindContextVars(s, args, contextVars)
+				statements1 = append(statements1, &SqlStatement{s, args})
+				continue
+			}
 			count, err := gosplitargs.CountSeparators(s, "\\?")
 			if err != nil {
-				if innerTrans {
-					tx.Rollback()
-				}
 				return nil, err
 			}
 			if len(params1) < totalCount+count {
+				return nil, errors.New(fmt.Sprintln("Incorrect param count. Expected: ", totalCount+count, " actual: ", len(params1)))
+			}
+			s, args, err := bindQueryValues(query, s, params1[totalCount:totalCount+count], scriptParams)
+			if err != nil {
+				return nil, err
+			}
+			s, args = bindContextVars(s, args, contextVars)
+			statements1 = append(statements1, &SqlStatement{s, args})
+			totalCount += count
+		}
+		statements = append(statements, statements1)
+	}
+	return statements, nil
+}
+
+// ExecResult is the outcome of one statement of a batch. Row is the
+// inserted row, the first one of a multi row insert, only fetched on
+// request.
+type ExecResult struct {
+	RowsAffected int64             `json:"rows_affected"`
+	LastInsertId int64             `json:"last_insert_id"`
+	Row          map[string]string `json:"row,omitempty"`
+	table        string
+}
+
+func batchExecuteTx(tx *sql.Tx, db *sql.DB, query map[string]string, script *string, scriptParams []string, params [][]interface{}, contextVars map[string]interface{}) ([][]int64, error) {
+	results, err := batchExecuteResultsTx(tx, db, query, script, scriptParams, params, contextVars)
+	if err != nil {
+		return nil, err
+	}
+	return rowsAffectedOf(results), nil
+}
+
+// batchExecuteResultsTx works like batchExecuteTx, but keeps the last insert
+// id of every statement as well.
+func batchExecuteResultsTx(tx *sql.Tx, db *sql.DB, query map[string]string, script *string, scriptParams []string, params [][]interface{}, contextVars map[string]interface{}) ([][]*ExecResult, error) {
+
+	results := [][]*ExecResult{}
+
+	statements, err := prepareBatch(query, script, scriptParams, params, contextVars)
+	if err != nil {
+		return results, err
+	}
+
+	innerTrans := false
+	if tx == nil {
+		tx, err = db.Begin()
+		innerTrans = true
+		if err != nil {
+			return results, err
+		}
+	}
+
+	for _, statements1 := range statements {
+		results1 := []*ExecResult{}
+		for _, statement := range statements1 {
+			result, err := tx.Exec(statement.Sql, statement.Args...)
+			if err != nil {
 				if innerTrans {
 					tx.Rollback()
 				}
-				return nil, errors.New(fmt.Sprintln("Incorrect param count. Expected: ", totalCount+count, " actual: ", len(params1)))
+				return nil, err
 			}
-			rowsAffected, err := gosqljson.ExecTx(tx, s, params1[totalCount:totalCount+count]...)
+			execResult := &ExecResult{}
+			execResult.RowsAffected, err = result.RowsAffected()
 			if err != nil {
 				if innerTrans {
 					tx.Rollback()
 				}
 				return nil, err
 			}
-			rowsAffectedArray1 = append(rowsAffectedArray1, rowsAffected)
-			totalCount += count
+			execResult.LastInsertId, _ = result.LastInsertId()
+			if match := writtenTableRegexps[0].FindStringSubmatch(statement.Sql); match != nil {
+				execResult.table = strings.Replace(match[1], "`", "", -1)
+			}
+			results1 = append(results1, execResult)
 		}
-		rowsAffectedArray = append(rowsAffectedArray, rowsAffectedArray1)
+		results = append(results, results1)
 	}
 
 	if innerTrans {
 		tx.Commit()
 	}
 
-	return rowsAffectedArray, nil
+	return results, nil
 }
 
-func buildReplaceContext(context map[string]interface{}) map[string]string {
-	replaceContext := map[string]string{}
-	if clientIp, ok := context["client_ip"].(string); ok {
-		replaceContext["__ip__"] = clientIp
-	}
-	if loginUserId, ok := context["user_id"].(string); ok {
-		replaceContext["__login_user_id__"] = loginUserId
-	}
-	if loginUserCode, ok := context["email"].(string); ok {
-		replaceContext["__login_user_code__"] = loginUserCode
-	}
-	if tokenUserId, ok := context["token_user_id"].(string); ok {
-		replaceContext["__token_user_id__"] = tokenUserId
+func rowsAffectedOf(results [][]*ExecResult) [][]int64 {
+	rowsAffectedArray := [][]int64{}
+	for _, results1 := range results {
+		rowsAffectedArray1 := []int64{}
+		for _, result := range results1 {
+			rowsAffectedArray1 = append(rowsAffectedArray1, result.RowsAffected)
+		}
+		rowsAffectedArray = append(rowsAffectedArray, rowsAffectedArray1)
 	}
-	if tokenUserCode, ok := context["token_user_code"].(string); ok {
-		replaceContext["__token_user_code__"] = tokenUserCode
+	return rowsAffectedArray
+}
+
+// fetchInsertedRows loads the rows inserted by the statements of results by
+// the primary key of their tables. LAST_INSERT_ID is the id of the first
+// row of a multi row insert, so only that row is fetched for them, and
+// tables without a single column primary key are skipped.
+func fetchInsertedRows(tx *sql.Tx, c string, results [][]*ExecResult) error {
+	primaryKeys := map[string]string{}
+	for _, results1 := range results {
+		for _, result := range results1 {
+			if result.table == "" || result.LastInsertId == 0 {
+				continue
+			}
+			primaryKey, ok := primaryKeys[result.table]
+			if !ok {
+				keys, err := gosqljson.QueryTxToMap(tx, "upper",
+					"SHOW KEYS FROM "+quoteIdentifier(result.table)+" WHERE Key_name='PRIMARY'")
+				if err != nil {
+					return err
+				}
+				if len(keys) == 1 {
+					primaryKey = keys[0]["COLUMN_NAME"]
+				}
+				primaryKeys[result.table] = primaryKey
+			}
+			if primaryKey == "" {
+				continue
+			}
+			rows, err := gosqljson.QueryTxToMap(tx, c,
+				"SELECT * FROM "+quoteIdentifier(result.table)+" WHERE "+quoteIdentifier(primaryKey)+"=?", result.LastInsertId)
+			if err != nil {
+				return err
+			}
+			if len(rows) == 1 {
+				result.Row = rows[0]
+			}
+		}
 	}
-	return replaceContext
+	return nil
 }
 
 func buildParams(clientData string) ([]string, [][]interface{}, error) {
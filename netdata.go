@@ -26,7 +26,7 @@ var makeGetDbo = func(dbType string) func(id string) gorest2.DataOperator {
 			return nil
 		}
 		query := `SELECT data_store.*, 
-			CONCAT_WS('_','nd',project.PROJECT_KEY) AS DB,project.ID AS PROJECT_ID,project.PROJECT_KEY FROM project
+			CONCAT_WS('_','nd',project.PROJECT_KEY) AS DB,project.ID AS PROJECT_ID,project.PROJECT_KEY,project.QUERY_TIMEOUT FROM project
 			INNER JOIN data_store ON project.DATA_STORE_NAME=data_store.DATA_STORE_NAME WHERE project.ID=?`
 		data, err := gosqljson.QueryDbToMap(db, "", query, id)
 		if err != nil {
@@ -40,6 +40,11 @@ var makeGetDbo = func(dbType string) func(id string) gorest2.DataOperator {
 		ds := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", dboData["PROJECT_KEY"], dboData["PROJECT_ID"],
 			dboData["HOST"], dboData["PORT"], dboData["DB"])
 		ret = NewDbo(ds, dbType)
+		queryTimeout, err := parseQueryTimeout(dboData["QUERY_TIMEOUT"])
+		if err != nil {
+			fmt.Println(err)
+		}
+		ret.(*NdDataOperator).SetQueryTimeout(queryTimeout)
 		gorest2.DboRegistry[id] = ret
 		return ret
 	}
@@ -90,8 +95,28 @@ func main() {
 	gorest2.DboRegistry["default"] = dbo
 	gorest2.GetDbo = makeGetDbo(dbType)
 
+	egress, err = parseEgressPolicy(grConfig["egress_allow"], grConfig["egress_deny"])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	defaultDb, err := dbo.GetConn()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = migrate(defaultDb)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	pushNode = grConfig["push_node"].(bool)
 	if pushNode {
+		workers, _ := grConfig["push_workers"].(float64)
+		workersPerUrl, _ := grConfig["push_workers_per_url"].(float64)
+		pushWorkers = newPushPool(int(workers), int(workersPerUrl))
 		initCache()
 	}
 	jobNode = grConfig["job_node"].(bool)
@@ -109,7 +134,7 @@ func main() {
 		}
 	}
 
-	gorest2.RegisterHandler("/api", gorest2.RestFunc)
+	gorest2.RegisterHandler("/api", apiFunc)
 	gorest2.StartDaemons(dbo)
 
 	grConfig.Serve()
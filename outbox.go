@@ -0,0 +1,200 @@
+// outbox
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+)
+
+// After remote interceptor events go through an outbox table in the
+// database of the project. When the change that raised an event runs in a
+// transaction, the event is written in that transaction, so it exists if
+// and only if the change was committed, and it is relayed to
+// push_notification after the commit. Relaying uses the outbox id as the
+// id of the push notification and skips ids already queued, so an event
+// relayed twice, by the writer and by the sweep job, is only queued once.
+// Changes made outside of a transaction write and relay their events right
+// away. That includes the REST CRUD of tables, which gorest2 commits before
+// the After hooks run: their events are lost if the node dies in between,
+// only those of stored query execs are covered by the outbox.
+const createOutboxTable = `CREATE TABLE IF NOT EXISTS %s.nd_outbox (
+	ID VARCHAR(32) NOT NULL PRIMARY KEY,
+	SEQ BIGINT NOT NULL AUTO_INCREMENT UNIQUE,
+	EVENT TEXT NOT NULL,
+	CREATE_TIME DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8 COLLATE utf8_unicode_ci`
+
+const maxOutboxRelay = 1000
+
+// outboxEvent is what an event says about itself. The outbox is a table of
+// the project, so anything in it may have been written by the project: the
+// project is the one whose outbox it is, and where and how it is delivered
+// is read from the remote interceptor when it is relayed, which must be an
+// enabled after interceptor of that project for the target and action of
+// the event.
+type outboxEvent struct {
+	RiId        string `json:"ri_id"`
+	Target      string `json:"target"`
+	Action      string `json:"action"`
+	Data        string `json:"data"`
+	CreatorId   string `json:"creator_id"`
+	CreatorCode string `json:"creator_code"`
+}
+
+// ensureOutboxTable creates the outbox in the database of a project, when
+// the project is created or updated. It cannot be done lazily, as DDL would
+// commit the transaction of the first event.
+func ensureOutboxTable(db *sql.DB, dbName string) error {
+	_, err := gosqljson.ExecDb(db, fmt.Sprintf(createOutboxTable, quoteIdentifier(dbName)))
+	return err
+}
+
+// writeOutbox adds an event to the outbox, in tx when there is one, and
+// returns its id.
+func writeOutbox(tx *sql.Tx, db *sql.DB, event *outboxEvent) (string, error) {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	id := newDeliveryId()
+	insert := `INSERT INTO nd_outbox(ID,EVENT,CREATE_TIME) VALUES(?,?,?)`
+	if tx != nil {
+		_, err = gosqljson.ExecTx(tx, insert, id, string(jsonData), time.Now().UTC())
+	} else {
+		_, err = gosqljson.ExecDb(db, insert, id, string(jsonData), time.Now().UTC())
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func projectConn(projectId string) (*sql.DB, error) {
+	dbo := gorest2.GetDbo(projectId)
+	if dbo == nil {
+		return nil, errors.New("Project not found.")
+	}
+	return dbo.GetConn()
+}
+
+// relayOutbox moves events from the outbox of a project to push_notification,
+// the given ones, or all of them with no ids.
+func relayOutbox(projectId string, ids []string) error {
+	projectDb, err := projectConn(projectId)
+	if err != nil {
+		return err
+	}
+	query := `SELECT * FROM nd_outbox`
+	params := []interface{}{}
+	if len(ids) > 0 {
+		query += fmt.Sprint(` WHERE ID IN(`, GeneratePlaceholders(len(ids)), `)`)
+		for _, id := range ids {
+			params = append(params, id)
+		}
+	}
+	query += fmt.Sprint(` ORDER BY SEQ LIMIT `, maxOutboxRelay)
+	data, err := gosqljson.QueryDbToMap(projectDb, "upper", query, params...)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	defaultDbo := gorest2.GetDbo("default")
+	defaultDb, err := defaultDbo.GetConn()
+	if err != nil {
+		return err
+	}
+	insert := `INSERT INTO push_notification(ID,PROJECT_ID,TARGET,METHOD,URL,TYPE,ACTION_TYPE,STATUS,DATA,CALLBACK,
+	RI_ID,MAX_ATTEMPTS,BACKOFF,RETRY_STATUS_CODES,ATTEMPTS,
+	CREATOR_ID,CREATOR_CODE,CREATE_TIME,UPDATER_ID,UPDATER_CODE,UPDATE_TIME)
+	VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+	ON DUPLICATE KEY UPDATE ID=ID`
+	ris := map[string]map[string]string{}
+	relayed := []interface{}{}
+	for _, row := range data {
+		event := &outboxEvent{}
+		err = json.Unmarshal([]byte(row["EVENT"]), event)
+		if err != nil {
+			// it would never relay
+			fmt.Println(row["ID"], err)
+			relayed = append(relayed, row["ID"])
+			continue
+		}
+		ri, ok := ris[event.RiId]
+		if !ok {
+			ri, err = loadRemoteInterceptorById(defaultDb, event.RiId)
+			if err != nil {
+				// left for the sweep
+				fmt.Println(err)
+				break
+			}
+			ris[event.RiId] = ri
+		}
+		if ri["project_id"] != projectId || ri["type"] != "after" ||
+			ri["target"] != event.Target || ri["action_type"] != event.Action || !riEnabled(ri["enabled"]) {
+			fmt.Println("Outbox event", row["ID"], "of", projectId, "dropped, no matching enabled remote interceptor.")
+			relayed = append(relayed, row["ID"])
+			continue
+		}
+		now := time.Now().UTC()
+		_, err = gosqljson.ExecDb(defaultDb, insert,
+			row["ID"], projectId, event.Target, ri["method"], ri["url"], "after", event.Action, pushStatusPending,
+			event.Data, ri["callback"], ri["id"], ri["max_attempts"], ri["backoff"], ri["retry_status_codes"], 0,
+			event.CreatorId, event.CreatorCode, row["CREATE_TIME"], event.CreatorId, event.CreatorCode, now)
+		if err != nil {
+			// left for the sweep
+			fmt.Println(err)
+			break
+		}
+		relayed = append(relayed, row["ID"])
+	}
+	if len(relayed) == 0 {
+		return nil
+	}
+	_, err = gosqljson.ExecDb(projectDb, fmt.Sprint(`DELETE FROM nd_outbox WHERE ID IN(`,
+		GeneratePlaceholders(len(relayed)), `)`), relayed...)
+	return err
+}
+
+// relayOutboxAfterCommit relays the events written in the transaction of
+// a stored query once it is committed.
+func relayOutboxAfterCommit(projectId string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	err := relayOutbox(projectId, ids)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// sweepOutboxes relays the events the projects with after interceptors
+// still have in their outbox, those whose writer went away between commit
+// and relay.
+func sweepOutboxes() error {
+	defaultDbo := gorest2.GetDbo("default")
+	defaultDb, err := defaultDbo.GetConn()
+	if err != nil {
+		return err
+	}
+	projects, err := gosqljson.QueryDbToMap(defaultDb, "upper",
+		`SELECT DISTINCT PROJECT_ID FROM remote_interceptor WHERE TYPE='after'`)
+	if err != nil {
+		return err
+	}
+	for _, project := range projects {
+		err = relayOutbox(project["PROJECT_ID"], nil)
+		if err != nil {
+			fmt.Println(project["PROJECT_ID"], err)
+		}
+	}
+	return nil
+}
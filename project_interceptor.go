@@ -24,6 +24,12 @@ type ProjectInterceptor struct {
 }
 
 func (this *ProjectInterceptor) BeforeCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	for _, data1 := range data {
+		_, err := parseQueryTimeout(data1["QUERY_TIMEOUT"])
+		if err != nil {
+			return false, err
+		}
+	}
 	tx, err := db.Begin()
 	if err != nil {
 		return false, err
@@ -42,6 +48,12 @@ func (this *ProjectInterceptor) BeforeCreate(resourceId string, db *sql.DB, cont
 	return true, nil
 }
 func (this *ProjectInterceptor) BeforeUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	for _, data1 := range data {
+		_, err := parseQueryTimeout(data1["QUERY_TIMEOUT"])
+		if err != nil {
+			return false, err
+		}
+	}
 	tx, err := db.Begin()
 	if err != nil {
 		return false, err
@@ -132,6 +144,12 @@ func afterCreateOrUpdateProject(context map[string]interface{}, data map[string]
 		return err
 	}
 
+	err = ensureOutboxTable(projectDb, dbName)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
 	return nil
 }
 
@@ -156,6 +174,12 @@ func (this *ProjectInterceptor) AfterUpdate(resourceId string, db *sql.DB, conte
 		if err != nil {
 			return err
 		}
+		if timeout, ok := data1["QUERY_TIMEOUT"]; ok {
+			if dbo, ok := gorest2.DboRegistry[data1["ID"].(string)].(*NdDataOperator); ok {
+				queryTimeout, _ := parseQueryTimeout(timeout)
+				dbo.SetQueryTimeout(queryTimeout)
+			}
+		}
 	}
 	return nil
 }
@@ -207,6 +231,11 @@ func (this *ProjectInterceptor) AfterDelete(resourceId string, db *sql.DB, conte
 			return err
 		}
 
+		_, err = gosqljson.ExecDb(db, `DELETE FROM query_version WHERE PROJECT_ID=?`, id1)
+		if err != nil {
+			return err
+		}
+
 		_, err = gosqljson.ExecDb(db, `DELETE FROM remote_interceptor WHERE PROJECT_ID=?`, id1)
 		if err != nil {
 			return err
@@ -0,0 +1,84 @@
+// push_attempts
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqljson"
+)
+
+const (
+	maxAttemptResponseBytes = 4096
+	pushAttemptRetention    = 30 * 24 * time.Hour
+)
+
+// pushAttempt is what one attempt to deliver a push notification sent and
+// got back. Every attempt is logged in push_notification_attempt, with
+// credentials left out of the headers and the response cut to 4KB.
+type pushAttempt struct {
+	Header     http.Header
+	StatusCode int
+	Response   []byte
+	Duration   time.Duration
+	Err        error
+}
+
+func (this *pushAttempt) error() string {
+	if this.Err != nil {
+		return this.Err.Error()
+	}
+	if this.StatusCode != 200 {
+		return fmt.Sprint("HTTP status ", this.StatusCode)
+	}
+	return ""
+}
+
+var redactedHeaderWords = []string{"auth", "token", "key", "secret", "cookie", "password"}
+
+func redactHeaders(header http.Header) string {
+	redacted := map[string]string{}
+	for k, v := range header {
+		value := strings.Join(v, ", ")
+		lower := strings.ToLower(k)
+		for _, word := range redactedHeaderWords {
+			if strings.Contains(lower, word) {
+				value = "[redacted]"
+				break
+			}
+		}
+		redacted[k] = value
+	}
+	jsonData, err := json.Marshal(redacted)
+	if err != nil {
+		return ""
+	}
+	return string(jsonData)
+}
+
+func logPushAttempt(db *sql.DB, v map[string]string, attempts int, attempt *pushAttempt) {
+	response := truncateUtf8(string(attempt.Response), maxAttemptResponseBytes)
+	var statusCode interface{}
+	if attempt.StatusCode > 0 {
+		statusCode = attempt.StatusCode
+	}
+	_, err := gosqljson.ExecDb(db, `INSERT INTO push_notification_attempt(ID,PUSH_NOTIFICATION_ID,PROJECT_ID,ATTEMPT,
+		URL,METHOD,REQUEST_HEADERS,STATUS_CODE,RESPONSE,DURATION_MS,ERROR,CREATE_TIME)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?)`,
+		newDeliveryId(), v["ID"], v["PROJECT_ID"], attempts,
+		v["URL"], v["METHOD"], redactHeaders(attempt.Header), statusCode, response,
+		int64(attempt.Duration/time.Millisecond), truncateLastError(attempt.error()), time.Now().UTC())
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func prunePushAttempts(db *sql.DB) error {
+	_, err := gosqljson.ExecDb(db, `DELETE FROM push_notification_attempt WHERE CREATE_TIME<?`,
+		time.Now().UTC().Add(-pushAttemptRetention))
+	return err
+}
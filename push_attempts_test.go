@@ -0,0 +1,60 @@
+// push_attempts_test
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPushAttemptHeaders(t *testing.T) {
+	ri := map[string]string{
+		"headers":          `{"X-Api-Key":"k1","X-Trace":"t1"}`,
+		"auth_type":        "bearer",
+		"auth_credentials": "s3cr3t",
+		"secret":           "signing",
+	}
+	opts, err := parseRiOptions(ri, "d1", `{"a":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := redactHeaders(opts.Header)
+	for _, secret := range []string{"k1", "s3cr3t", "signing"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("%q leaked into %s", secret, logged)
+		}
+	}
+	headers := map[string]string{}
+	err = json.Unmarshal([]byte(logged), &headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers["X-Trace"] != "t1" || headers["Authorization"] != "[redacted]" || headers["X-Api-Key"] != "[redacted]" {
+		t.Errorf("got %v", headers)
+	}
+}
+
+func TestTruncateUtf8(t *testing.T) {
+	s := strings.Repeat("é", 10)
+	for n := 0; n <= len(s)+1; n++ {
+		cut := truncateUtf8(s, n)
+		if len(cut) > n || !utf8.ValidString(cut) || len(cut) < n-1 && len(cut) != len(s) {
+			t.Errorf("truncateUtf8(%d) got %q", n, cut)
+		}
+	}
+}
+
+func TestParsePushTimeRange(t *testing.T) {
+	r := httptest.NewRequest("GET", "/push?from=2016-01-02T08:00:00%2B08:00&to=2016-01-03", nil)
+	from, to, err := parsePushTimeRange(r)
+	if err != nil || from != "2016-01-02 00:00:00" || to != "2016-01-03 00:00:00" {
+		t.Errorf("got %q %q %v", from, to, err)
+	}
+	r = httptest.NewRequest("GET", "/push?to=yesterday", nil)
+	_, _, err = parsePushTimeRange(r)
+	if err == nil || err.Error() != "Invalid to: yesterday" {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+// push_delivery
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	maxPushBatch      = 1000
+	maxPushGroupBatch = 100
+	pushLockTTL       = 5 * time.Minute
+
+	defaultPushWorkers       = 16
+	defaultPushWorkersPerUrl = 4
+)
+
+// pushPool caps the deliveries in flight, in total and per url. The caps
+// are read from push_workers and push_workers_per_url of the config.
+type pushPool struct {
+	slots  chan struct{}
+	perUrl int
+	mutex  *sync.Mutex
+	urls   map[string]*urlSlots
+}
+
+type urlSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+var pushWorkers = newPushPool(defaultPushWorkers, defaultPushWorkersPerUrl)
+
+func newPushPool(workers, perUrl int) *pushPool {
+	if workers < 1 {
+		workers = defaultPushWorkers
+	}
+	if perUrl < 1 {
+		perUrl = defaultPushWorkersPerUrl
+	}
+	if perUrl > workers {
+		perUrl = workers
+	}
+	return &pushPool{
+		slots:  make(chan struct{}, workers),
+		perUrl: perUrl,
+		mutex:  &sync.Mutex{},
+		urls:   map[string]*urlSlots{},
+	}
+}
+
+// acquire waits for a slot of url, then for one of the pool, and returns
+// the func that gives both back.
+func (this *pushPool) acquire(url string) func() {
+	this.mutex.Lock()
+	u := this.urls[url]
+	if u == nil {
+		u = &urlSlots{slots: make(chan struct{}, this.perUrl)}
+		this.urls[url] = u
+	}
+	u.refs++
+	this.mutex.Unlock()
+
+	u.slots <- struct{}{}
+	this.slots <- struct{}{}
+	return func() {
+		<-this.slots
+		<-u.slots
+		this.mutex.Lock()
+		u.refs--
+		if u.refs == 0 {
+			delete(this.urls, url)
+		}
+		this.mutex.Unlock()
+	}
+}
+
+type pushGroup struct {
+	ProjectId string
+	Target    string
+	Ids       []interface{}
+}
+
+// deliverPushNotifications delivers the due push notifications. They are
+// grouped by project and target, and each group is delivered in order, one
+// notification at a time, under a lock shared by all push nodes, so
+// receivers see the events of a target in the order they were queued. A
+// notification waiting for its retry holds back the ones queued after it.
+// Groups are delivered concurrently, within the caps of the pool.
+func deliverPushNotifications(db *sql.DB) {
+	reclaimPushNotifications(db)
+	data, err := gosqljson.QueryDbToMap(db, "", `SELECT ID,PROJECT_ID,TARGET,
+		(NEXT_ATTEMPT_TIME IS NULL OR NEXT_ATTEMPT_TIME<=CONVERT_TZ(NOW(),'System','+0:0')) AS DUE
+		FROM push_notification WHERE STATUS=0 ORDER BY SEQ LIMIT ?`, maxPushBatch)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	groups := []*pushGroup{}
+	groupIndex := map[string]*pushGroup{}
+	blocked := map[string]bool{}
+	for _, v := range data {
+		key := v["PROJECT_ID"] + ":" + v["TARGET"]
+		if blocked[key] {
+			continue
+		}
+		if v["DUE"] != "1" {
+			blocked[key] = true
+			continue
+		}
+		group := groupIndex[key]
+		if group == nil {
+			group = &pushGroup{ProjectId: v["PROJECT_ID"], Target: v["TARGET"]}
+			groupIndex[key] = group
+			groups = append(groups, group)
+		}
+		if len(group.Ids) < maxPushGroupBatch {
+			group.Ids = append(group.Ids, v["ID"])
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group *pushGroup) {
+			defer wg.Done()
+			deliverPushGroup(db, group)
+		}(group)
+	}
+	wg.Wait()
+}
+
+func deliverPushGroup(db *sql.DB, group *pushGroup) {
+	claimId := uuid.NewV4().String()
+	lockKey := fmt.Sprint("push_lock:", group.ProjectId, ":", group.Target)
+	locked, err := gorest2.RedisMaster.SetNX(lockKey, claimId, pushLockTTL).Result()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !locked {
+		// another run is delivering this group
+		return
+	}
+	defer func() {
+		if gorest2.RedisMaster.Get(lockKey).Val() == claimId {
+			gorest2.RedisMaster.Del(lockKey)
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// keep the lock while waiting for the pool too, or another run
+		// could deliver later notifications of the group first
+		ticker := time.NewTicker(pushLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if gorest2.RedisMaster.Get(lockKey).Val() == claimId {
+					gorest2.RedisMaster.Expire(lockKey, pushLockTTL)
+				}
+			}
+		}
+	}()
+
+	params := append([]interface{}{claimId, time.Now().UTC()}, group.Ids...)
+	_, err = gosqljson.ExecDb(db, fmt.Sprint(`UPDATE push_notification SET STATUS=?,CLAIM_TIME=? WHERE STATUS=0 AND ID IN(`,
+		GeneratePlaceholders(len(group.Ids)), `)`), params...)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() {
+		// hand back what was claimed but not attempted
+		_, err := gosqljson.ExecDb(db, `UPDATE push_notification SET STATUS=0,CLAIM_TIME=NULL WHERE STATUS=?`, claimId)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	data, err := gosqljson.QueryDbToMap(db, "", `SELECT * FROM push_notification WHERE STATUS=? ORDER BY SEQ`, claimId)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, v := range data {
+		release := pushWorkers.acquire(v["URL"])
+		status := deliverPushNotification(db, v)
+		release()
+		if status == pushStatusPending {
+			// keep the order, the rest waits for the retry
+			break
+		}
+	}
+}
+
+// reclaimPushNotifications hands back the notifications claimed by a run
+// that died while delivering them. A live run keeps the lock of its group,
+// so claims older than the lock of a group nobody holds are stale.
+func reclaimPushNotifications(db *sql.DB) {
+	before := time.Now().UTC().Add(-pushLockTTL)
+	data, err := gosqljson.QueryDbToMap(db, "", `SELECT DISTINCT PROJECT_ID,TARGET FROM push_notification
+		WHERE CLAIM_TIME<? AND STATUS NOT IN(?,?,?)`,
+		before, pushStatusPending, pushStatusDelivered, pushStatusDead)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, v := range data {
+		lockKey := fmt.Sprint("push_lock:", v["PROJECT_ID"], ":", v["TARGET"])
+		if gorest2.RedisMaster.Exists(lockKey).Val() {
+			continue
+		}
+		_, err = gosqljson.ExecDb(db, `UPDATE push_notification SET STATUS=0,CLAIM_TIME=NULL
+			WHERE PROJECT_ID=? AND TARGET=? AND CLAIM_TIME<? AND STATUS NOT IN(?,?,?)`,
+			v["PROJECT_ID"], v["TARGET"], before, pushStatusPending, pushStatusDelivered, pushStatusDead)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
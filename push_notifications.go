@@ -0,0 +1,189 @@
+// push_notifications
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+)
+
+// deliverPushNotification makes one attempt to deliver a claimed push
+// notification, runs its callback on success, and records the outcome. It
+// returns the new status of the notification.
+func deliverPushNotification(db *sql.DB, v map[string]string) string {
+	ri, err := loadPushRemoteInterceptor(db, v)
+	if err != nil {
+		return recordPushAttempt(db, v, &pushAttempt{Err: err}, true)
+	}
+	opts, err := parseRiOptions(ri, v["ID"], v["DATA"])
+	if err != nil {
+		return recordPushAttempt(db, v, &pushAttempt{Err: err}, false)
+	}
+	attempt := &pushAttempt{Header: opts.Header}
+	start := time.Now()
+	res, statusCode, err := httpRequest(v["URL"], v["METHOD"], v["DATA"], -1, opts)
+	attempt.Duration = time.Since(start)
+	attempt.Response = res
+	if err != nil {
+		attempt.Err = err
+		// hosts refused by the egress policy stay refused
+		return recordPushAttempt(db, v, attempt, !isEgressDenied(err))
+	}
+	attempt.StatusCode = statusCode
+	if statusCode != 200 {
+		return recordPushAttempt(db, v, attempt, true)
+	}
+	err = runPushCallback(v, string(res))
+	if err != nil {
+		fmt.Println(err)
+		attempt.Err = errors.New("Callback failed: " + err.Error())
+	}
+	return recordPushAttempt(db, v, attempt, false)
+}
+
+// loadPushRemoteInterceptor loads the remote interceptor that queued a push
+// notification. Notifications queued before RI_ID was recorded are matched
+// to the after interceptor of their project, target, action and url, and
+// take its retry policy. When there is none, they are delivered the way
+// they used to be, without verifying TLS certificates.
+func loadPushRemoteInterceptor(db *sql.DB, v map[string]string) (map[string]string, error) {
+	if v["RI_ID"] != "" {
+		return loadRemoteInterceptorById(db, v["RI_ID"])
+	}
+	data, err := gosqljson.QueryDbToMap(db, "lower", `SELECT * FROM remote_interceptor
+		WHERE PROJECT_ID=? AND TARGET=? AND TYPE='after' AND ACTION_TYPE=? AND URL=? ORDER BY ID LIMIT 1`,
+		v["PROJECT_ID"], v["TARGET"], v["ACTION_TYPE"], v["URL"])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return map[string]string{"tls_verify": "0"}, nil
+	}
+	ri := data[0]
+	if v["MAX_ATTEMPTS"] == "" {
+		v["MAX_ATTEMPTS"] = ri["max_attempts"]
+		v["BACKOFF"] = ri["backoff"]
+		v["RETRY_STATUS_CODES"] = ri["retry_status_codes"]
+	}
+	return ri, nil
+}
+
+func runPushCallback(v map[string]string, clientData string) error {
+	callback := v["CALLBACK"]
+	if strings.TrimSpace(callback) == "" {
+		return nil
+	}
+	// return a array of array as parameters for callback
+	appId := v["PROJECT_ID"]
+	query, err := loadQuery(appId, callback)
+	if err != nil {
+		return err
+	}
+	scripts := query["script"]
+	contextVars := map[string]interface{}{
+		"__token_user_id__":   v["CREATOR_ID"],
+		"__token_user_code__": v["CREATOR_CODE"],
+		"__login_user_id__":   v["CREATOR_ID"],
+		"__login_user_code__": v["CREATOR_CODE"],
+	}
+	queryParams, params, err := buildParams(clientData)
+	if err != nil {
+		return err
+	}
+	appDbo := gorest2.GetDbo(appId)
+	if appDbo == nil {
+		return errors.New("Project not found.")
+	}
+	appDb, err := appDbo.GetConn()
+	if err != nil {
+		return err
+	}
+	_, err = batchExecuteTx(nil, appDb, query, &scripts, queryParams, params, contextVars)
+	if err != nil {
+		return err
+	}
+	invalidateQueryCache(appId, writtenTables(scripts))
+	return nil
+}
+
+// recordPushAttempt counts and logs an attempt. A notification that got a
+// 200 is delivered, even when its callback failed. Any other outcome is
+// scheduled for another attempt when retry allows it and the retry policy
+// of the notification agrees, otherwise the notification is dead.
+func recordPushAttempt(db *sql.DB, v map[string]string, attempt *pushAttempt, retry bool) string {
+	attempts, _ := strconv.Atoi(v["ATTEMPTS"])
+	attempts++
+	statusCode := attempt.StatusCode
+	lastError := attempt.error()
+	now := time.Now().UTC()
+	logPushAttempt(db, v, attempts, attempt)
+
+	status := pushStatusDelivered
+	var nextAttemptTime interface{}
+	if statusCode != 200 {
+		status = pushStatusDead
+		policy, perr := parsePushRetryPolicy(v["MAX_ATTEMPTS"], v["BACKOFF"], v["RETRY_STATUS_CODES"])
+		if perr != nil {
+			fmt.Println(perr)
+		} else if retry && attempts < policy.MaxAttempts && policy.retryable(statusCode, attempt.Err) {
+			status = pushStatusPending
+			nextAttemptTime = now.Add(policy.delay(attempts))
+		}
+	}
+	_, err := gosqljson.ExecDb(db, `UPDATE push_notification SET STATUS=?,ATTEMPTS=?,LAST_ERROR=?,NEXT_ATTEMPT_TIME=?,
+		CLAIM_TIME=NULL,UPDATE_TIME=? WHERE ID=?`,
+		status, attempts, truncateLastError(lastError), nextAttemptTime, now, v["ID"])
+	if err != nil {
+		fmt.Println(err)
+	}
+	return status
+}
+
+// pushReplay selects the notifications of a project to deliver again:
+// the given ones, whether they were delivered or died, or the dead ones
+// created in a time range, or all dead ones.
+type pushReplay struct {
+	Ids  []string
+	From string
+	To   string
+	All  bool
+}
+
+// replayPushNotifications puts notifications back in the queue with a
+// fresh attempt count and no last error. Their attempt log is kept.
+func replayPushNotifications(db *sql.DB, projectId string, replay *pushReplay, userToken map[string]string) (int64, error) {
+	update := `UPDATE push_notification SET STATUS=?,ATTEMPTS=0,LAST_ERROR=NULL,NEXT_ATTEMPT_TIME=NULL,
+		UPDATER_ID=?,UPDATER_CODE=?,UPDATE_TIME=? WHERE PROJECT_ID=?`
+	params := []interface{}{pushStatusPending, userToken["ID"], userToken["EMAIL"], time.Now().UTC(), projectId}
+	switch {
+	case len(replay.Ids) > 0:
+		update += fmt.Sprint(" AND STATUS IN(?,?) AND ID IN(", GeneratePlaceholders(len(replay.Ids)), ")")
+		params = append(params, pushStatusDelivered, pushStatusDead)
+		for _, id := range replay.Ids {
+			params = append(params, id)
+		}
+	case replay.From != "" || replay.To != "":
+		update += " AND STATUS=?"
+		params = append(params, pushStatusDead)
+		if replay.From != "" {
+			update += " AND CREATE_TIME>=?"
+			params = append(params, replay.From)
+		}
+		if replay.To != "" {
+			update += " AND CREATE_TIME<?"
+			params = append(params, replay.To)
+		}
+	case replay.All:
+		update += " AND STATUS=?"
+		params = append(params, pushStatusDead)
+	default:
+		return 0, errors.New("Nothing to replay.")
+	}
+	return gosqljson.ExecDb(db, update, params...)
+}
@@ -0,0 +1,147 @@
+// push_retry
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	pushStatusPending   = "0"
+	pushStatusDelivered = "-1"
+	// a notification that failed its last attempt stays dead until it is
+	// replayed
+	pushStatusDead = "1"
+
+	defaultPushBackoff    = 30 * time.Second
+	maxPushBackoff        = time.Hour
+	maxPushAttempts       = 100
+	maxPushLastErrorBytes = 1000
+)
+
+// pushRetryPolicy is read from the MAX_ATTEMPTS, BACKOFF and
+// RETRY_STATUS_CODES columns of a remote interceptor, and copied to every
+// push notification it queues. MAX_ATTEMPTS counts the first attempt and
+// defaults to 1, so nothing is retried unless asked for. BACKOFF is a JSON
+// array of the seconds to wait after each failed attempt, the last entry
+// repeats; without one the wait starts at 30 seconds and doubles up to an
+// hour. RETRY_STATUS_CODES is a JSON array of status codes or classes like
+// "5xx" that are worth another attempt, 408, 429 and 5xx by default.
+// Attempts that fail to connect are always retried.
+type pushRetryPolicy struct {
+	MaxAttempts int
+	Backoff     []time.Duration
+	StatusCodes []string
+}
+
+var defaultRetryStatusCodes = []string{"408", "429", "5xx"}
+
+func parsePushRetryPolicy(maxAttempts, backoff, statusCodes string) (*pushRetryPolicy, error) {
+	policy := &pushRetryPolicy{MaxAttempts: 1, StatusCodes: defaultRetryStatusCodes}
+	if strings.TrimSpace(maxAttempts) != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(maxAttempts))
+		if err != nil || n < 0 || n > maxPushAttempts {
+			return nil, errors.New(fmt.Sprint("Invalid max attempts: ", maxAttempts))
+		}
+		if n > 0 {
+			policy.MaxAttempts = n
+		}
+	}
+	if strings.TrimSpace(backoff) != "" {
+		schedule := []float64{}
+		err := json.Unmarshal([]byte(backoff), &schedule)
+		if err != nil {
+			return nil, errors.New("Invalid backoff: " + err.Error())
+		}
+		for _, seconds := range schedule {
+			if seconds < 0 {
+				return nil, errors.New(fmt.Sprint("Invalid backoff: ", backoff))
+			}
+			policy.Backoff = append(policy.Backoff, time.Duration(seconds*float64(time.Second)))
+		}
+	}
+	if strings.TrimSpace(statusCodes) != "" {
+		codes := []interface{}{}
+		err := json.Unmarshal([]byte(statusCodes), &codes)
+		if err != nil {
+			return nil, errors.New("Invalid retry status codes: " + err.Error())
+		}
+		policy.StatusCodes = []string{}
+		for _, code := range codes {
+			s := strings.ToLower(fmt.Sprint(code))
+			if !isStatusCodePattern(s) {
+				return nil, errors.New(fmt.Sprint("Invalid retry status code: ", code))
+			}
+			policy.StatusCodes = append(policy.StatusCodes, s)
+		}
+	}
+	return policy, nil
+}
+
+func isStatusCodePattern(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// retryable tells whether an attempt that ended with statusCode, or failed
+// with err before a response came back, is worth another one.
+func (this *pushRetryPolicy) retryable(statusCode int, err error) bool {
+	if err != nil {
+		return true
+	}
+	code := strconv.Itoa(statusCode)
+	for _, pattern := range this.StatusCodes {
+		if pattern == code || (strings.HasSuffix(pattern, "xx") && pattern[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay is the wait after the given number of failed attempts.
+func (this *pushRetryPolicy) delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if len(this.Backoff) > 0 {
+		if attempts > len(this.Backoff) {
+			return this.Backoff[len(this.Backoff)-1]
+		}
+		return this.Backoff[attempts-1]
+	}
+	delay := defaultPushBackoff
+	for i := 1; i < attempts && delay < maxPushBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPushBackoff {
+		delay = maxPushBackoff
+	}
+	return delay
+}
+
+func truncateLastError(s string) string {
+	return truncateUtf8(s, maxPushLastErrorBytes)
+}
+
+// truncateUtf8 cuts s to at most n bytes, on a rune boundary so the column
+// it goes to is still valid utf8.
+func truncateUtf8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
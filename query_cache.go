@@ -0,0 +1,220 @@
+// query_cache
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosplitargs"
+)
+
+// queryCachePolicy is read from the CACHE_TTL and CACHE_DEPENDS columns of a
+// query. CACHE_TTL is in seconds, CACHE_DEPENDS is a JSON array of the table
+// names the query reads. Cached results are dropped whenever a stored query,
+// a callback or /exec writes to one of these tables, or to tables it does
+// not tell.
+type queryCachePolicy struct {
+	TTL     time.Duration
+	Depends []string
+}
+
+func parseQueryCachePolicy(ttl, depends string) (*queryCachePolicy, error) {
+	if strings.TrimSpace(ttl) == "" || ttl == "0" {
+		return nil, nil
+	}
+	seconds, err := strconv.Atoi(ttl)
+	if err != nil || seconds < 0 {
+		return nil, errors.New(fmt.Sprint("Invalid cache ttl: ", ttl))
+	}
+	policy := &queryCachePolicy{TTL: time.Duration(seconds) * time.Second}
+	if strings.TrimSpace(depends) != "" {
+		tables := []string{}
+		err = json.Unmarshal([]byte(depends), &tables)
+		if err != nil {
+			return nil, errors.New("Invalid cache depends: " + err.Error())
+		}
+		for _, table := range tables {
+			policy.Depends = append(policy.Depends, normalizeTableName(table))
+		}
+	}
+	return policy, nil
+}
+
+func normalizeTableName(table string) string {
+	table = strings.Replace(strings.TrimSpace(table), "`", "", -1)
+	return strings.ToLower(table[strings.LastIndex(table, ".")+1:])
+}
+
+func queryGenerationKey(projectId, table string) string {
+	return fmt.Sprint("qgen:", projectId, ":", table)
+}
+
+// queryCacheKey derives the cache key from the final script and args, so
+// params, query params and context placeholders are all accounted for, the
+// token user, and the current generation of every table the query depends
+// on. Bumping a generation makes the old entries unreachable, they are left
+// to expire. The key is empty when the query is not cached, or runs in a
+// batch transaction that may hold uncommitted writes.
+func queryCacheKey(pq *preparedQuery, context map[string]interface{}, array bool) (string, error) {
+	if pq.Cache == nil || pq.Tx != nil {
+		return "", nil
+	}
+	projectId := context["app_id"].(string)
+	keys := []string{queryGenerationKey(projectId, allTables)}
+	for _, table := range pq.Cache.Depends {
+		keys = append(keys, queryGenerationKey(projectId, table))
+	}
+	generations, err := gorest2.RedisLocal.MGet(keys...).Result()
+	if err != nil {
+		return "", err
+	}
+	material, err := json.Marshal([]interface{}{
+		pq.Script, pq.Args, context["case"], context["token_user_id"], array, generations,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(material)
+	return fmt.Sprint("qcache:", projectId, ":", pq.TableId, ":", hex.EncodeToString(sum[:])), nil
+}
+
+// getCachedQuery unmarshals a cached result into v and tells whether there
+// was one.
+func getCachedQuery(key string, v interface{}) bool {
+	cached, err := gorest2.RedisLocal.Get(key).Result()
+	if err != nil || cached == "" {
+		return false
+	}
+	return json.Unmarshal([]byte(cached), v) == nil
+}
+
+func setCachedQuery(key string, policy *queryCachePolicy, v interface{}) error {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return gorest2.RedisMaster.Set(key, string(jsonData), policy.TTL).Err()
+}
+
+// allTables stands for the tables of a statement that writes to tables it
+// does not tell, like a multi-table update. Its generation is part of the
+// key of every cached query of the project.
+const allTables = "*"
+
+// The table of a statement is captured loosely, to be checked by
+// isTableName. Updates and deletes only match when they write to a single
+// table.
+var writtenTableRegexps = []*regexp.Regexp{
+	regexp.MustCompile("(?is)^\\s*(?:INSERT|REPLACE)\\s+(?:(?:LOW_PRIORITY|DELAYED|HIGH_PRIORITY|IGNORE)\\s+)*(?:INTO\\s+)?([^\\s(,]+)"),
+	regexp.MustCompile("(?is)^\\s*UPDATE\\s+(?:(?:LOW_PRIORITY|IGNORE)\\s+)*([^\\s(,]+)(?:\\s+(?:AS\\s+)?\\w+)?\\s+SET\\b"),
+	regexp.MustCompile("(?is)^\\s*DELETE\\s+(?:(?:LOW_PRIORITY|QUICK|IGNORE)\\s+)*FROM\\s+([^\\s(,]+)(?:\\s+(?:AS\\s+)?\\w+)?\\s*(?:$|\\b(?:WHERE|ORDER|LIMIT|PARTITION)\\b)"),
+	regexp.MustCompile("(?is)^\\s*(?:TRUNCATE(?:\\s+TABLE)?|(?:DROP|ALTER)\\s+TABLE(?:\\s+IF\\s+EXISTS)?)\\s+([^\\s(,]+)(?:\\s*$|\\s+[^,\\s])"),
+}
+
+// readStatements are the first words of statements that write to no table.
+var readStatements = map[string]bool{
+	"SELECT": true, "SHOW": true, "EXPLAIN": true, "DESC": true, "DESCRIBE": true,
+	"SET": true, "BEGIN": true, "START": true, "COMMIT": true, "ROLLBACK": true,
+	"SAVEPOINT": true, "RELEASE": true,
+}
+
+// writtenTables returns the tables the statements of script write to. A
+// statement that writes to tables it does not tell, or that is not
+// understood, is counted as writing to allTables.
+func writtenTables(script string) []string {
+	statements, err := gosplitargs.SplitArgs(script, ";", true)
+	if err != nil {
+		return []string{allTables}
+	}
+	tables := []string{}
+	for _, statement := range statements {
+		statement = trimLeadingComments(statement)
+		if statement == "" {
+			continue
+		}
+		if table := writtenTable(statement); table != "" {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+func writtenTable(statement string) string {
+	word := statement
+	if i := strings.IndexFunc(statement, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		word = statement[:i]
+	}
+	if readStatements[strings.ToUpper(word)] {
+		return ""
+	}
+	for _, re := range writtenTableRegexps {
+		if match := re.FindStringSubmatch(statement); match != nil {
+			if !isTableName(match[1]) {
+				// like a $N
+				return allTables
+			}
+			return normalizeTableName(match[1])
+		}
+	}
+	return allTables
+}
+
+func isTableName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if !isParamPart(name[i]) && name[i] != '.' && name[i] != '`' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// trimLeadingComments drops the whitespace and comments a statement starts
+// with. A /*! comment is run by MySQL, and is kept.
+func trimLeadingComments(statement string) string {
+	for {
+		statement = strings.TrimSpace(statement)
+		if statement == "" || strings.HasPrefix(statement, "/*!") {
+			return statement
+		}
+		if statement[0] != '#' && statement[0] != '-' && statement[0] != '/' {
+			return statement
+		}
+		j := skipSqlQuoted(statement, 0)
+		if j == 0 {
+			return statement
+		}
+		statement = statement[j:]
+	}
+}
+
+func invalidateQueryCache(projectId string, tables []string) {
+	for _, table := range tables {
+		err := gorest2.RedisMaster.Incr(queryGenerationKey(projectId, table)).Err()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// recordQueryCacheWrites invalidates the tables script writes to right away
+// when it ran outside of a transaction, or remembers them in the context to
+// be invalidated once the transaction of Exec is committed.
+func recordQueryCacheWrites(tx *sql.Tx, context map[string]interface{}, script string) {
+	tables := writtenTables(script)
+	if tx == nil {
+		invalidateQueryCache(context["app_id"].(string), tables)
+		return
+	}
+	written, _ := context["written_tables"].([]string)
+	context["written_tables"] = append(written, tables...)
+}
@@ -0,0 +1,37 @@
+// query_cache_test
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWrittenTables(t *testing.T) {
+	expected := map[string][]string{
+		"INSERT INTO `db`.`Users`(ID) VALUES(?)":                {"users"},
+		"insert ignore t SELECT * FROM s":                       {"t"},
+		"UPDATE t SET A=1; UPDATE LOW_PRIORITY t2 AS x SET B=2": {"t", "t2"},
+		"DELETE FROM t WHERE ID=?":                              {"t"},
+		"DELETE QUICK FROM t AS a ORDER BY ID LIMIT 1":          {"t"},
+		"DELETE FROM t": {"t"},
+		"TRUNCATE t; ALTER TABLE t2 ADD COLUMN C INT": {"t", "t2"},
+		"SELECT * FROM t; SHOW TABLES":                {},
+		"-- cleanup\n/* old rows */ DELETE FROM t":    {"t"},
+		"# cleanup\nUPDATE t SET A=1":                 {"t"},
+		"UPDATE a JOIN b ON a.ID=b.ID SET a.X=b.X":    {allTables},
+		"UPDATE a, b SET a.X=b.X":                     {allTables},
+		"DELETE a FROM a JOIN b ON a.ID=b.ID":         {allTables},
+		"DELETE FROM a USING a JOIN b":                {allTables},
+		"DELETE FROM a, b USING a JOIN b":             {allTables},
+		"DROP TABLE a, b":                             {allTables},
+		"INSERT INTO $0 VALUES(?)":                    {allTables},
+		"UPDATE $0 SET A=1":                           {allTables},
+		"CALL cleanup()":                              {allTables},
+		"/*!40000 ALTER TABLE t DISABLE KEYS */":      {allTables},
+	}
+	for script, tables := range expected {
+		if got := writtenTables(script); !reflect.DeepEqual(got, tables) {
+			t.Errorf("writtenTables(%q) got %v, expected %v", script, got, tables)
+		}
+	}
+}
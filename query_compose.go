@@ -0,0 +1,179 @@
+// query_compose
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/elgs/gorest2"
+)
+
+const maxIncludeDepth = 16
+
+// findQueryIncludes returns the positions of the {{name}} includes of
+// script, ignoring quoted strings and comments. A name may be pinned to a
+// version with name@version.
+func findQueryIncludes(script string) [][2]int {
+	ret := [][2]int{}
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			i = j
+			continue
+		}
+		if strings.HasPrefix(script[i:], "{{") {
+			if k := strings.Index(script[i+2:], "}}"); k > 0 {
+				name := strings.TrimSpace(script[i+2 : i+2+k])
+				base, _ := splitQueryVersion(name)
+				if isParamName(base) {
+					ret = append(ret, [2]int{i, i + 2 + k + 2})
+					i += 2 + k + 2
+					continue
+				}
+			}
+		}
+		i++
+	}
+	return ret
+}
+
+// composeQuery expands the includes of a query definition in place. The
+// script of an included query replaces its {{name}}, without the trailing
+// semicolon, and its named params and identifier rules are merged into
+// the including query. The $N query params are shared by all the scripts,
+// so a $N used by both queries must have the same rule in both, or none.
+// stack holds the names being expanded, to detect cycles; included is
+// called with every query that was pulled in.
+func composeQuery(projectId string, queryMap map[string]string, stack []string, included func(name string)) error {
+	script := queryMap["script"]
+	includes := findQueryIncludes(script)
+	if len(includes) == 0 {
+		return nil
+	}
+	if len(stack) > maxIncludeDepth {
+		return errors.New("Query includes nested too deep.")
+	}
+
+	params, err := parseQueryParams(queryMap["params"])
+	if err != nil {
+		return err
+	}
+	identifiers, err := parseIdentifierRules(queryMap["identifiers"])
+	if err != nil {
+		return err
+	}
+
+	used := queryParamIndexes(script)
+
+	var buf bytes.Buffer
+	last := 0
+	for _, include := range includes {
+		name := strings.TrimSpace(script[include[0]+2 : include[1]-2])
+		base, _ := splitQueryVersion(name)
+		for _, s := range stack {
+			if s == base {
+				return errors.New(fmt.Sprint("Circular query include: ", strings.Join(append(stack, base), " -> ")))
+			}
+		}
+		includedMap, err := loadQueryDefinition(projectId, name)
+		if err != nil {
+			return errors.New(fmt.Sprint("Failed to include ", name, ": ", err.Error()))
+		}
+		err = composeQuery(projectId, includedMap, append(stack[:len(stack):len(stack)], base), included)
+		if err != nil {
+			return err
+		}
+		if included != nil {
+			included(base)
+		}
+
+		includedParams, err := parseQueryParams(includedMap["params"])
+		if err != nil {
+			return err
+		}
+		for _, includedParam := range includedParams {
+			merged := false
+			for _, param := range params {
+				if param.Name == includedParam.Name {
+					if param.Type != includedParam.Type {
+						return errors.New(fmt.Sprint("Conflicting param ", param.Name, " in ", name))
+					}
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				params = append(params, includedParam)
+			}
+		}
+		includedIdentifiers, err := parseIdentifierRules(includedMap["identifiers"])
+		if err != nil {
+			return err
+		}
+		includedUsed := queryParamIndexes(includedMap["script"])
+		for k := range includedIdentifiers {
+			index, _ := strconv.Atoi(k)
+			includedUsed[index] = true
+		}
+		for index := range includedUsed {
+			k := strconv.Itoa(index)
+			if (used[index] || identifiers[k] != nil) && !sameIdentifierRule(identifiers[k], includedIdentifiers[k]) {
+				return errors.New(fmt.Sprint("Conflicting query param $", index, " in ", name))
+			}
+			used[index] = true
+			if rule := includedIdentifiers[k]; rule != nil {
+				if identifiers == nil {
+					identifiers = map[string]*IdentifierRule{}
+				}
+				identifiers[k] = rule
+			}
+		}
+
+		buf.WriteString(script[last:include[0]])
+		buf.WriteString(strings.TrimRight(strings.TrimSpace(includedMap["script"]), ";"))
+		last = include[1]
+	}
+	buf.WriteString(script[last:])
+	queryMap["script"] = buf.String()
+
+	if len(params) > 0 {
+		jsonData, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		queryMap["params"] = string(jsonData)
+	}
+	if len(identifiers) > 0 {
+		jsonData, err := json.Marshal(identifiers)
+		if err != nil {
+			return err
+		}
+		queryMap["identifiers"] = string(jsonData)
+	}
+	return nil
+}
+
+func queryIncludersKey(projectId, name string) string {
+	return fmt.Sprint("query_includers:", projectId, ":", name)
+}
+
+// checkQueryIncludes makes sure a query about to be saved only includes
+// existing queries, does not end up including itself and agrees with them
+// on its params. queryMap is expanded in place.
+func checkQueryIncludes(projectId, name string, queryMap map[string]string) error {
+	if len(findQueryIncludes(queryMap["script"])) == 0 {
+		return nil
+	}
+	return composeQuery(projectId, queryMap, []string{name}, nil)
+}
+
+// clearQueryIncluders drops the cached definitions of the queries that
+// include the given one.
+func clearQueryIncluders(projectId, name string) error {
+	key := queryIncludersKey(projectId, name)
+	keys := append(gorest2.RedisLocal.SMembers(key).Val(), key)
+	return gorest2.RedisMaster.Del(keys...).Err()
+}
@@ -0,0 +1,153 @@
+// query_compose_test
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/elgs/gorest2"
+)
+
+// storedQueries is what the query table of the nd_query_test driver holds,
+// by query name.
+var storedQueries = map[string]map[string]string{}
+
+var storedQueryColumns = []string{"ID", "PROJECT_ID", "NAME", "SCRIPT", "PARAMS", "IDENTIFIERS", "ACTIVE_VERSION"}
+
+type queryTableDriver struct{}
+
+func init() {
+	sql.Register("nd_query_test", queryTableDriver{})
+}
+
+func (queryTableDriver) Open(name string) (driver.Conn, error) { return queryTableConn{}, nil }
+
+type queryTableConn struct{}
+
+func (queryTableConn) Prepare(query string) (driver.Stmt, error) {
+	if !strings.HasPrefix(query, "SELECT * FROM query WHERE ") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	return queryTableStmt{}, nil
+}
+func (queryTableConn) Close() error              { return nil }
+func (queryTableConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type queryTableStmt struct{}
+
+func (queryTableStmt) Close() error  { return nil }
+func (queryTableStmt) NumInput() int { return 2 }
+func (queryTableStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("read only")
+}
+
+func (queryTableStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &queryTableRows{}
+	if row, ok := storedQueries[args[1].(string)]; ok {
+		rows.rows = append(rows.rows, row)
+	}
+	return rows, nil
+}
+
+type queryTableRows struct {
+	rows []map[string]string
+}
+
+func (this *queryTableRows) Columns() []string { return storedQueryColumns }
+func (this *queryTableRows) Close() error      { return nil }
+func (this *queryTableRows) Next(dest []driver.Value) error {
+	if len(this.rows) == 0 {
+		return io.EOF
+	}
+	for i, column := range storedQueryColumns {
+		dest[i] = this.rows[0][column]
+	}
+	this.rows = this.rows[1:]
+	return nil
+}
+
+type queryTableDbo struct {
+	gorest2.DataOperator
+	db *sql.DB
+}
+
+func (this *queryTableDbo) GetConn() (*sql.DB, error) { return this.db, nil }
+
+func TestCheckQueryIncludes(t *testing.T) {
+	db, err := sql.Open("nd_query_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	getDbo := gorest2.GetDbo
+	defer func() { gorest2.GetDbo = getDbo }()
+	gorest2.GetDbo = func(id string) gorest2.DataOperator {
+		return &queryTableDbo{db: db}
+	}
+	storedQueries = map[string]map[string]string{
+		"by_table": {
+			"NAME":        "by_table",
+			"SCRIPT":      "SELECT * FROM $0 WHERE ID=:id;",
+			"PARAMS":      `[{"name":"id","type":"int"}]`,
+			"IDENTIFIERS": `{"0":{"values":["users","groups"]}}`,
+		},
+		"by_name": {
+			"NAME":   "by_name",
+			"SCRIPT": "SELECT * FROM users WHERE NAME=$0",
+		},
+		"loops": {
+			"NAME":   "loops",
+			"SCRIPT": "SELECT * FROM ({{loops}}) t",
+		},
+	}
+
+	t.Run("expands includes and merges their params", func(t *testing.T) {
+		queryMap := map[string]string{"script": "SELECT COUNT(*) FROM ({{by_table}}) t WHERE $1>0"}
+		err := checkQueryIncludes("p1", "counted", queryMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queryMap["script"] != "SELECT COUNT(*) FROM (SELECT * FROM $0 WHERE ID=:id) t WHERE $1>0" {
+			t.Errorf("script %q", queryMap["script"])
+		}
+		params, _ := parseQueryParams(queryMap["params"])
+		if len(params) != 1 || params[0].Name != "id" {
+			t.Errorf("params %q", queryMap["params"])
+		}
+		rules, _ := parseIdentifierRules(queryMap["identifiers"])
+		if rules["0"] == nil || len(rules["0"].Values) != 2 {
+			t.Errorf("identifiers %q", queryMap["identifiers"])
+		}
+	})
+
+	t.Run("rejects a $N the including query uses otherwise", func(t *testing.T) {
+		queryMap := map[string]string{"script": "SELECT * FROM ({{by_table}}) t WHERE NAME=$0"}
+		err := checkQueryIncludes("p1", "mixed", queryMap)
+		if err == nil || err.Error() != "Conflicting query param $0 in by_table" {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("rejects two includes that disagree on a $N", func(t *testing.T) {
+		queryMap := map[string]string{"script": "{{by_table}} UNION {{by_name}}"}
+		err := checkQueryIncludes("p1", "both", queryMap)
+		if err == nil || err.Error() != "Conflicting query param $0 in by_name" {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("rejects circular and missing includes", func(t *testing.T) {
+		err := checkQueryIncludes("p1", "outer", map[string]string{"script": "{{loops}}"})
+		if err == nil || !strings.HasPrefix(err.Error(), "Circular query include: ") {
+			t.Errorf("got %v", err)
+		}
+		err = checkQueryIncludes("p1", "outer", map[string]string{"script": "{{nowhere}}"})
+		if err == nil || !strings.HasPrefix(err.Error(), "Failed to include nowhere") {
+			t.Errorf("got %v", err)
+		}
+	})
+}
@@ -0,0 +1,304 @@
+// query_cursor
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/elgs/gorest2"
+)
+
+const (
+	maxPageSize  = 1000
+	cursorMarker = "__cursor__"
+)
+
+// cursorKey is one sort key of a paginated stored query. The CURSOR column
+// of the query table holds a JSON array like ["CREATE_TIME DESC", "ID"];
+// the keys must identify a row uniquely and be part of the select list.
+type cursorKey struct {
+	Column string
+	Desc   bool
+}
+
+// name is the column label of the key in the result set.
+func (this *cursorKey) name() string {
+	return this.Column[strings.LastIndex(this.Column, ".")+1:]
+}
+
+// sql is the quoted key, qualified with alias when the script is wrapped.
+func (this *cursorKey) sql(alias string) string {
+	if alias == "" {
+		return quoteIdentifier(this.Column)
+	}
+	return alias + "." + quoteIdentifier(this.name())
+}
+
+func parseCursorKeys(schema string) ([]*cursorKey, error) {
+	if strings.TrimSpace(schema) == "" {
+		return nil, nil
+	}
+	keys := []string{}
+	err := json.Unmarshal([]byte(schema), &keys)
+	if err != nil {
+		return nil, errors.New("Invalid cursor schema: " + err.Error())
+	}
+	ret := []*cursorKey{}
+	for _, key := range keys {
+		fields := strings.Fields(key)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New(fmt.Sprint("Invalid cursor key: ", key))
+		}
+		for _, part := range strings.Split(fields[0], ".") {
+			if !isParamName(part) {
+				return nil, errors.New(fmt.Sprint("Invalid cursor key: ", key))
+			}
+		}
+		ck := &cursorKey{Column: fields[0]}
+		if len(fields) == 2 {
+			switch strings.ToUpper(fields[1]) {
+			case "ASC":
+			case "DESC":
+				ck.Desc = true
+			default:
+				return nil, errors.New(fmt.Sprint("Invalid cursor key: ", key))
+			}
+		}
+		ret = append(ret, ck)
+	}
+	return ret, nil
+}
+
+func encodeCursor(queryName string, values []string) string {
+	jsonData, _ := json.Marshal(map[string]interface{}{"q": queryName, "v": values})
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+func decodeCursor(queryName string, cursor string, keys []*cursorKey) ([]string, error) {
+	jsonData, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("Invalid cursor.")
+	}
+	c := struct {
+		Q string   `json:"q"`
+		V []string `json:"v"`
+	}{}
+	err = json.Unmarshal(jsonData, &c)
+	if err != nil || c.Q != queryName || len(c.V) != len(keys) {
+		return nil, errors.New("Invalid cursor.")
+	}
+	return c.V, nil
+}
+
+// cursorPredicate builds the keyset condition that selects the rows after
+// values, expanded into ORs so MySQL can use an index on the keys.
+func cursorPredicate(keys []*cursorKey, values []string, alias string) (string, []interface{}) {
+	ors := []string{}
+	args := []interface{}{}
+	for i, key := range keys {
+		ands := []string{}
+		for j := 0; j < i; j++ {
+			ands = append(ands, keys[j].sql(alias)+"=?")
+			args = append(args, values[j])
+		}
+		op := ">"
+		if key.Desc {
+			op = "<"
+		}
+		ands = append(ands, key.sql(alias)+op+"?")
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+func cursorOrderBy(keys []*cursorKey, alias string) string {
+	orders := []string{}
+	for _, key := range keys {
+		order := key.sql(alias)
+		if key.Desc {
+			order += " DESC"
+		}
+		orders = append(orders, order)
+	}
+	return " ORDER BY " + strings.Join(orders, ",")
+}
+
+// QueryPage runs a stored query that declares cursor keys and returns one
+// page of rows plus the cursor of the next page, empty on the last page.
+// The script may place __cursor__ in its WHERE clause to have the keyset
+// condition applied in place, otherwise the script is wrapped.
+func (this *NdDataOperator) QueryPage(tableId string, params []interface{}, queryParams []string, context map[string]interface{}, cursor string, pageSize int) ([]map[string]string, string, error) {
+	if pageSize <= 0 || pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	pq, err := this.prepareQuery(tableId, params, queryParams, context, false)
+	if pq == nil {
+		if err == nil {
+			err = errors.New("Query rejected.")
+		}
+		return nil, "", err
+	}
+	keys, err := parseCursorKeys(pq.Query["cursor"])
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("Query does not support cursors.")
+	}
+
+	var values []string
+	if cursor != "" {
+		values, err = decodeCursor(pq.TableId, cursor, keys)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var script string
+	args := []interface{}{}
+	if marker := findCursorMarker(pq.Script); marker >= 0 {
+		predicate, predicateArgs := "1=1", []interface{}{}
+		if values != nil {
+			predicate, predicateArgs = cursorPredicate(keys, values, "")
+		}
+		before := countPlaceholders(pq.Script[:marker])
+		script = pq.Script[:marker] + predicate + pq.Script[marker+len(cursorMarker):] + cursorOrderBy(keys, "") + " LIMIT ?"
+		args = append(args, pq.Args[:before]...)
+		args = append(args, predicateArgs...)
+		args = append(args, pq.Args[before:]...)
+	} else {
+		predicate, predicateArgs := "1=1", []interface{}{}
+		if values != nil {
+			predicate, predicateArgs = cursorPredicate(keys, values, "a")
+		}
+		script = "SELECT * FROM (" + pq.Script + ") a WHERE " + predicate + cursorOrderBy(keys, "a") + " LIMIT ?"
+		args = append(args, pq.Args...)
+		args = append(args, predicateArgs...)
+	}
+	args = append(args, pageSize+1)
+
+	c := context["case"].(string)
+	m, err := pq.queryMap(c, script, args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if len(m) > pageSize {
+		m = m[:pageSize]
+		last := m[pageSize-1]
+		values := []string{}
+		for _, key := range keys {
+			column := key.name()
+			value, found := last[column]
+			if !found {
+				for k, v := range last {
+					if strings.EqualFold(k, column) {
+						value, found = v, true
+						break
+					}
+				}
+			}
+			if !found {
+				return nil, "", errors.New(fmt.Sprint("Cursor key not selected: ", key.Column))
+			}
+			values = append(values, value)
+		}
+		nextCursor = encodeCursor(pq.TableId, values)
+	}
+
+	dataInterceptors, sortedKeys := gorest2.GetDataInterceptors(pq.TableId)
+	for _, k := range sortedKeys {
+		dataInterceptor := dataInterceptors[k]
+		if dataInterceptor != nil {
+			dataInterceptor.AfterQueryMap(pq.TableId, pq.Script, &pq.Params, pq.Db, context, &m)
+		}
+	}
+	globalDataInterceptors, globalSortedKeys := gorest2.GetGlobalDataInterceptors()
+	for _, k := range globalSortedKeys {
+		globalDataInterceptor := globalDataInterceptors[k]
+		globalDataInterceptor.AfterQueryMap(pq.TableId, pq.Script, &pq.Params, pq.Db, context, &m)
+	}
+	return m, nextCursor, nil
+}
+
+// findCursorMarker returns the position of __cursor__ outside of quotes and
+// comments, or -1.
+func findCursorMarker(script string) int {
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			i = j
+			continue
+		}
+		if strings.HasPrefix(script[i:], cursorMarker) {
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+// checkCursorScript makes sure a script using __cursor__ can take the
+// ORDER BY and LIMIT QueryPage appends to it: nothing after the marker may
+// order or limit the outer query.
+func checkCursorScript(script string) error {
+	marker := findCursorMarker(script)
+	if marker < 0 {
+		return nil
+	}
+	depth := 0
+	for i := marker + len(cursorMarker); i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			i = j
+			continue
+		}
+		switch c := script[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && isParamStart(c) && !isParamPart(script[i-1]):
+			j := i
+			for j < len(script) && isParamPart(script[j]) {
+				j++
+			}
+			word := strings.ToUpper(script[i:j])
+			if word == "LIMIT" || (word == "ORDER" && strings.HasPrefix(strings.ToUpper(strings.TrimSpace(script[j:])), "BY")) {
+				return errors.New("Cursor queries using " + cursorMarker + " cannot have their own ORDER BY or LIMIT.")
+			}
+			i = j
+			continue
+		}
+		i++
+	}
+	return nil
+}
+
+func countPlaceholders(script string) int {
+	count := 0
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			i = j
+			continue
+		}
+		if script[i] == '?' {
+			count++
+		}
+		i++
+	}
+	return count
+}
+
+func parsePageSize(s string) int {
+	pageSize, err := strconv.Atoi(s)
+	if err != nil {
+		return maxPageSize
+	}
+	return pageSize
+}
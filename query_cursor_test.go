@@ -0,0 +1,125 @@
+// query_cursor_test
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCursorKeys(t *testing.T) {
+	var cases = []struct {
+		schema  string
+		columns []string
+		desc    []bool
+		err     bool
+	}{
+		{"", nil, nil, false},
+		{`["ID"]`, []string{"ID"}, []bool{false}, false},
+		{`["CREATE_TIME DESC", "t.ID asc"]`, []string{"CREATE_TIME", "t.ID"}, []bool{true, false}, false},
+		{`["ID DOWN"]`, nil, nil, true},
+		{`["ID DESC X"]`, nil, nil, true},
+		{`[""]`, nil, nil, true},
+		{`["ID;DROP"]`, nil, nil, true},
+		{`["t..ID"]`, nil, nil, true},
+		{`"ID"`, nil, nil, true},
+	}
+	for _, c := range cases {
+		keys, err := parseCursorKeys(c.schema)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseCursorKeys(%q) expected an error", c.schema)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCursorKeys(%q) unexpected error: %v", c.schema, err)
+			continue
+		}
+		if len(keys) != len(c.columns) {
+			t.Errorf("parseCursorKeys(%q) got %d keys, expected %d", c.schema, len(keys), len(c.columns))
+			continue
+		}
+		for i, key := range keys {
+			if key.Column != c.columns[i] || key.Desc != c.desc[i] {
+				t.Errorf("parseCursorKeys(%q)[%d] got %s %v, expected %s %v", c.schema, i, key.Column, key.Desc, c.columns[i], c.desc[i])
+			}
+		}
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	keys, err := parseCursorKeys(`["CREATE_TIME DESC", "ID"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{"2016-01-02 03:04:05", "a,b\"c"}
+	cursor := encodeCursor("list_users", values)
+	var cases = []struct {
+		queryName string
+		cursor    string
+		err       bool
+	}{
+		{"list_users", cursor, false},
+		{"list_orders", cursor, true},
+		{"list_users", encodeCursor("list_users", values[:1]), true},
+		{"list_users", "not a cursor", true},
+		{"list_users", "", true},
+		{"list_users", cursor + "x", true},
+	}
+	for _, c := range cases {
+		decoded, err := decodeCursor(c.queryName, c.cursor, keys)
+		if c.err {
+			if err == nil {
+				t.Errorf("decodeCursor(%q, %q) expected an error", c.queryName, c.cursor)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decodeCursor(%q, %q) unexpected error: %v", c.queryName, c.cursor, err)
+			continue
+		}
+		if len(decoded) != len(values) || decoded[0] != values[0] || decoded[1] != values[1] {
+			t.Errorf("decodeCursor(%q, %q) got %q, expected %q", c.queryName, c.cursor, decoded, values)
+		}
+	}
+}
+
+func TestCursorPredicate(t *testing.T) {
+	keys, err := parseCursorKeys(`["CREATE_TIME DESC", "ID"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	predicate, args := cursorPredicate(keys, []string{"t", "i"}, "a")
+	expected := "((a.`CREATE_TIME`<?) OR (a.`CREATE_TIME`=? AND a.`ID`>?))"
+	if predicate != expected || len(args) != 3 {
+		t.Errorf("cursorPredicate got %q %v, expected %q", predicate, args, expected)
+	}
+	if orderBy := cursorOrderBy(keys, ""); orderBy != " ORDER BY `CREATE_TIME` DESC,`ID`" {
+		t.Errorf("cursorOrderBy got %q", orderBy)
+	}
+}
+
+func TestCheckCursorScript(t *testing.T) {
+	var cases = []struct {
+		script string
+		err    bool
+	}{
+		{"SELECT * FROM t ORDER BY ID LIMIT 10", false},
+		{"SELECT * FROM t WHERE __cursor__", false},
+		{"SELECT * FROM t WHERE __cursor__ AND NAME IN (SELECT NAME FROM u ORDER BY ID LIMIT 1)", false},
+		{"SELECT * FROM t WHERE __cursor__ AND NAME='ORDER BY' -- LIMIT", false},
+		{"SELECT * FROM t WHERE __cursor__ AND SORT_ORDER>1 AND LIMITED=0", false},
+		{"SELECT * FROM t WHERE __cursor__ GROUP BY ID", false},
+		{"SELECT * FROM t WHERE __cursor__ ORDER BY ID", true},
+		{"SELECT * FROM t WHERE __cursor__ order\n by ID", true},
+		{"SELECT * FROM t WHERE __cursor__ LIMIT 10", true},
+	}
+	for _, c := range cases {
+		err := checkCursorScript(c.script)
+		if c.err && err == nil {
+			t.Errorf("checkCursorScript(%q) expected an error", c.script)
+		}
+		if !c.err && err != nil {
+			t.Errorf("checkCursorScript(%q) unexpected error: %v", c.script, err)
+		}
+	}
+}
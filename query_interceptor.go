@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
 )
 
 func init() {
@@ -21,16 +23,153 @@ type QueryInterceptor struct {
 func (this *QueryInterceptor) commonAfterCreateOrUpdateQuery(context map[string]interface{}) error {
 	queryName := context["old_data"].(map[string]string)["NAME"]
 	appId := context["old_data"].(map[string]string)["PROJECT_ID"]
-	key := fmt.Sprint("query:", appId, ":", queryName)
-	return gorest2.RedisMaster.Del(key).Err()
+	return clearQueryCache(appId, queryName, false)
+}
+
+// queryToSave is the definition of a query as it will be once data1 is
+// saved: the stored row for an update, with the columns sent over it.
+func queryToSave(db *sql.DB, data1 map[string]interface{}) (map[string]string, error) {
+	fields := []string{"PROJECT_ID", "NAME", "SCRIPT", "PARAMS", "IDENTIFIERS"}
+	ret := map[string]string{}
+	if id, ok := data1["ID"]; ok && id != nil {
+		stored, err := gosqljson.QueryDbToMap(db, "lower",
+			"SELECT "+strings.Join(fields, ",")+" FROM query WHERE ID=?", fmt.Sprint(id))
+		if err != nil {
+			return nil, err
+		}
+		if len(stored) > 0 {
+			ret = stored[0]
+		}
+	}
+	for _, field := range fields {
+		if v, ok := data1[field]; ok && v != nil {
+			ret[strings.ToLower(field)] = fmt.Sprint(v)
+		}
+	}
+	return ret, nil
+}
+
+func checkQueryParamsSchema(db *sql.DB, data []map[string]interface{}) error {
+	for _, data1 := range data {
+		if schema, ok := data1["PARAMS"].(string); ok {
+			_, err := parseQueryParams(schema)
+			if err != nil {
+				return err
+			}
+		}
+		if schema, ok := data1["IDENTIFIERS"].(string); ok {
+			_, err := parseIdentifierRules(schema)
+			if err != nil {
+				return err
+			}
+		}
+		if ttl, ok := data1["CACHE_TTL"]; ok && ttl != nil {
+			depends, _ := data1["CACHE_DEPENDS"].(string)
+			_, err := parseQueryCachePolicy(fmt.Sprint(ttl), depends)
+			if err != nil {
+				return err
+			}
+		}
+		isolation, _ := data1["ISOLATION_LEVEL"].(string)
+		readOnly := ""
+		if v, ok := data1["READ_ONLY"]; ok && v != nil {
+			readOnly = fmt.Sprint(v)
+		}
+		_, err := parseQueryTxOptions(isolation, readOnly)
+		if err != nil {
+			return err
+		}
+		_, err = parseQueryTimeout(data1["TIMEOUT"])
+		if err != nil {
+			return err
+		}
+		if mode, ok := data1["MODE"].(string); ok && mode != "" && mode != "multi" {
+			return errors.New("Invalid query mode: " + mode)
+		}
+		if name, ok := data1["NAME"].(string); ok && name == batchQueryName {
+			return errors.New("Query name reserved: " + name)
+		}
+		_, hasScript := data1["SCRIPT"]
+		_, hasParams := data1["PARAMS"]
+		_, hasIdentifiers := data1["IDENTIFIERS"]
+		if hasScript || hasParams || hasIdentifiers {
+			query, err := queryToSave(db, data1)
+			if err != nil {
+				return err
+			}
+			if query["project_id"] != "" {
+				err = checkQueryIncludes(query["project_id"], query["name"], query)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if script, ok := data1["SCRIPT"].(string); ok {
+			err := checkCursorScript(script)
+			if err != nil {
+				return err
+			}
+		}
+		if schema, ok := data1["SHAPE"].(string); ok {
+			_, err := parseQueryShape(schema)
+			if err != nil {
+				return err
+			}
+		}
+		if schema, ok := data1["CURSOR"].(string); ok {
+			_, err := parseCursorKeys(schema)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *QueryInterceptor) BeforeCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	err := checkQueryParamsSchema(db, data)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (this *QueryInterceptor) AfterCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) error {
+	for _, data1 := range data {
+		err := createQueryVersion(db, fmt.Sprint(data1["ID"]), context)
+		if err != nil {
+			return err
+		}
+		err = clearQueryCache(fmt.Sprint(data1["PROJECT_ID"]), fmt.Sprint(data1["NAME"]), false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (this *QueryInterceptor) BeforeUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	err := checkQueryParamsSchema(db, data)
+	if err != nil {
+		return false, err
+	}
 	context["load"] = true
 	return true, nil
 }
 
 func (this *QueryInterceptor) AfterUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) error {
+	err := createQueryVersion(db, context["old_data"].(map[string]string)["ID"], context)
+	if err != nil {
+		return err
+	}
+	for _, data1 := range data {
+		if name, ok := data1["NAME"].(string); ok {
+			err = clearQueryCache(context["old_data"].(map[string]string)["PROJECT_ID"], name, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return this.commonAfterCreateOrUpdateQuery(context)
 }
 
@@ -40,7 +179,12 @@ func (this *QueryInterceptor) BeforeDelete(resourceId string, db *sql.DB, contex
 }
 
 func (this *QueryInterceptor) AfterDelete(resourceId string, db *sql.DB, context map[string]interface{}, id []string) error {
-	return this.commonAfterCreateOrUpdateQuery(context)
+	oldData := context["old_data"].(map[string]string)
+	_, err := gosqljson.ExecDb(db, "DELETE FROM query_version WHERE QUERY_ID=?", oldData["ID"])
+	if err != nil {
+		return err
+	}
+	return clearQueryCache(oldData["PROJECT_ID"], oldData["NAME"], true)
 }
 
 func (this *QueryInterceptor) BeforeListMap(resourceId string, db *sql.DB, fields string, context map[string]interface{}, filter *string, sort *string, group *string, start int64, limit int64) (bool, error) {
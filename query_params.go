@@ -0,0 +1,505 @@
+// query_params
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// QueryParam declares one :name parameter of a stored query. The PARAMS
+// column of the query table holds a JSON array of these.
+type QueryParam struct {
+	Name      string      `json:"name"`
+	Type      string      `json:"type"` // string, int, float, bool, datetime
+	Required  bool        `json:"required"`
+	Default   interface{} `json:"default"`
+	MaxLength int         `json:"max_length"`
+}
+
+type ParamError struct {
+	Name    string
+	Message string
+}
+
+type ParamErrors []*ParamError
+
+func (this ParamErrors) Error() string {
+	msgs := make([]string, 0, len(this))
+	for _, e := range this {
+		msgs = append(msgs, e.Name+": "+e.Message)
+	}
+	return "Invalid params. " + strings.Join(msgs, "; ")
+}
+
+var paramTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+func parseQueryParams(schema string) ([]*QueryParam, error) {
+	if strings.TrimSpace(schema) == "" {
+		return nil, nil
+	}
+	defs := []*QueryParam{}
+	err := json.Unmarshal([]byte(schema), &defs)
+	if err != nil {
+		return nil, errors.New("Invalid params schema: " + err.Error())
+	}
+	names := map[string]bool{}
+	for _, def := range defs {
+		if !isParamName(def.Name) {
+			return nil, errors.New(fmt.Sprint("Invalid param name: ", def.Name))
+		}
+		if names[def.Name] {
+			return nil, errors.New(fmt.Sprint("Duplicate param name: ", def.Name))
+		}
+		names[def.Name] = true
+		switch def.Type {
+		case "":
+			def.Type = "string"
+		case "string", "int", "float", "bool", "datetime":
+		default:
+			return nil, errors.New(fmt.Sprint("Invalid param type: ", def.Type))
+		}
+	}
+	return defs, nil
+}
+
+// resolveQueryParams validates the client supplied values against the
+// schema. Values come either as a single JSON object keyed by name, or
+// positionally in the declared order.
+func resolveQueryParams(defs []*QueryParam, params []interface{}) (map[string]interface{}, error) {
+	input := map[string]interface{}{}
+	if len(params) == 1 {
+		if m, ok := params[0].(map[string]interface{}); ok {
+			input = m
+			params = nil
+		}
+	}
+	if len(params) > len(defs) {
+		return nil, errors.New(fmt.Sprintln("Incorrect param count. Expected: ", len(defs), " actual: ", len(params)))
+	}
+	for i, v := range params {
+		input[defs[i].Name] = v
+	}
+
+	paramErrors := ParamErrors{}
+	declared := map[string]bool{}
+	values := map[string]interface{}{}
+	for _, def := range defs {
+		declared[def.Name] = true
+		v, found := input[def.Name]
+		if !found || v == nil {
+			if def.Default != nil {
+				v = def.Default
+			} else if def.Required {
+				paramErrors = append(paramErrors, &ParamError{def.Name, "is required."})
+				continue
+			} else {
+				values[def.Name] = nil
+				continue
+			}
+		}
+		converted, err := convertParam(def, v)
+		if err != nil {
+			paramErrors = append(paramErrors, &ParamError{def.Name, err.Error()})
+			continue
+		}
+		values[def.Name] = converted
+	}
+	for k := range input {
+		if !declared[k] {
+			paramErrors = append(paramErrors, &ParamError{k, "is not declared."})
+		}
+	}
+	if len(paramErrors) > 0 {
+		return nil, paramErrors
+	}
+	return values, nil
+}
+
+func convertParam(def *QueryParam, v interface{}) (interface{}, error) {
+	switch def.Type {
+	case "int":
+		switch t := v.(type) {
+		case float64:
+			if t != float64(int64(t)) {
+				return nil, errors.New("must be an integer.")
+			}
+			return int64(t), nil
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+			if err != nil {
+				return nil, errors.New("must be an integer.")
+			}
+			return i, nil
+		}
+		return nil, errors.New("must be an integer.")
+	case "float":
+		switch t := v.(type) {
+		case float64:
+			return t, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+			if err != nil {
+				return nil, errors.New("must be a number.")
+			}
+			return f, nil
+		}
+		return nil, errors.New("must be a number.")
+	case "bool":
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case float64:
+			if t == 0 || t == 1 {
+				return t == 1, nil
+			}
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(t))
+			if err == nil {
+				return b, nil
+			}
+		}
+		return nil, errors.New("must be a boolean.")
+	case "datetime":
+		if s, ok := v.(string); ok {
+			for _, layout := range paramTimeLayouts {
+				t, err := time.Parse(layout, strings.TrimSpace(s))
+				if err == nil {
+					return t.UTC(), nil
+				}
+			}
+		}
+		return nil, errors.New("must be a datetime.")
+	}
+
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case float64, bool:
+		s = fmt.Sprint(t)
+	default:
+		return nil, errors.New("must be a string.")
+	}
+	if def.MaxLength > 0 && utf8.RuneCountInString(s) > def.MaxLength {
+		return nil, errors.New(fmt.Sprint("exceeds max length ", def.MaxLength, "."))
+	}
+	return s, nil
+}
+
+// bindNamedParams rewrites every :name outside of quotes and comments into
+// a ? placeholder and returns the matching arguments in order.
+func bindNamedParams(script string, defs []*QueryParam, values map[string]interface{}) (string, []interface{}, error) {
+	declared := map[string]bool{}
+	for _, def := range defs {
+		declared[def.Name] = true
+	}
+	var ret []byte
+	args := []interface{}{}
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			ret = append(ret, script[i:j]...)
+			i = j
+			continue
+		}
+		c := script[i]
+		if c == '?' {
+			return "", nil, errors.New("Positional parameters cannot be mixed with named parameters.")
+		}
+		if c == ':' && i+1 < len(script) && isParamStart(script[i+1]) && (i == 0 || script[i-1] != ':') {
+			j := i + 1
+			for j < len(script) && isParamPart(script[j]) {
+				j++
+			}
+			name := script[i+1 : j]
+			if !declared[name] {
+				return "", nil, errors.New(fmt.Sprint("Undeclared param: ", name))
+			}
+			ret = append(ret, '?')
+			args = append(args, values[name])
+			i = j
+			continue
+		}
+		ret = append(ret, c)
+		i++
+	}
+	return string(ret), args, nil
+}
+
+// bindQueryParams binds the named params of a stored query if it declares a
+// params schema, otherwise the script and params are returned untouched.
+func bindQueryParams(query map[string]string, script string, params []interface{}) (string, []interface{}, error) {
+	defs, err := parseQueryParams(query["params"])
+	if err != nil || len(defs) == 0 {
+		return script, params, err
+	}
+	values, err := resolveQueryParams(defs, params)
+	if err != nil {
+		return "", nil, err
+	}
+	return bindNamedParams(script, defs, values)
+}
+
+// skipSqlQuoted returns the index right after the quoted string, quoted
+// identifier or comment starting at i, or i if there is none.
+func skipSqlQuoted(script string, i int) int {
+	c := script[i]
+	switch {
+	case c == '\'' || c == '"' || c == '`':
+		j := i + 1
+		for j < len(script) {
+			if script[j] == '\\' && c != '`' {
+				j += 2
+				continue
+			}
+			if script[j] == c {
+				if j+1 < len(script) && script[j+1] == c {
+					j += 2
+					continue
+				}
+				return j + 1
+			}
+			j++
+		}
+		return len(script)
+	case c == '#' || (c == '-' && strings.HasPrefix(script[i:], "-- ")):
+		j := strings.IndexByte(script[i:], '\n')
+		if j < 0 {
+			return len(script)
+		}
+		return i + j
+	case c == '/' && strings.HasPrefix(script[i:], "/*"):
+		j := strings.Index(script[i+2:], "*/")
+		if j < 0 {
+			return len(script)
+		}
+		return i + 2 + j + 2
+	}
+	return i
+}
+
+func isParamName(name string) bool {
+	if name == "" || !isParamStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isParamPart(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isParamStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isParamPart(c byte) bool {
+	return isParamStart(c) || (c >= '0' && c <= '9')
+}
+
+// IdentifierRule is the allow-list for one $N query param. The IDENTIFIERS
+// column holds a JSON object keyed by the param index, e.g.
+// {"0": {"type": "identifier", "values": ["NAME", "CREATE_TIME"]},
+// "1": {"type": "keyword", "values": ["ASC", "DESC"]}}. A $N without a rule
+// is bound as a value, so names and keywords must be listed to be used.
+type IdentifierRule struct {
+	Type   string   `json:"type"` // identifier, keyword
+	Values []string `json:"values"`
+}
+
+func parseIdentifierRules(schema string) (map[string]*IdentifierRule, error) {
+	if strings.TrimSpace(schema) == "" {
+		return nil, nil
+	}
+	parsed := map[string]*IdentifierRule{}
+	err := json.Unmarshal([]byte(schema), &parsed)
+	if err != nil {
+		return nil, errors.New("Invalid identifiers schema: " + err.Error())
+	}
+	rules := map[string]*IdentifierRule{}
+	for k, rule := range parsed {
+		index, err := strconv.Atoi(k)
+		if err != nil || index < 0 {
+			return nil, errors.New(fmt.Sprint("Invalid identifier index: ", k))
+		}
+		if rule == nil {
+			return nil, errors.New(fmt.Sprint("Invalid identifier rule: $", k))
+		}
+		switch rule.Type {
+		case "":
+			rule.Type = "identifier"
+		case "identifier", "keyword":
+		default:
+			return nil, errors.New(fmt.Sprint("Invalid identifier type: ", rule.Type))
+		}
+		rules[strconv.Itoa(index)] = rule
+	}
+	return rules, nil
+}
+
+// matchQueryParam returns the index of the $N at i of s and its length, or
+// a length of 0 when there is none.
+func matchQueryParam(s string, i int) (int, int) {
+	if s[i] != '$' || i+1 >= len(s) || s[i+1] < '0' || s[i+1] > '9' {
+		return 0, 0
+	}
+	if i > 0 && (isParamPart(s[i-1]) || s[i-1] == '$') {
+		return 0, 0
+	}
+	j := i + 1
+	for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+		j++
+	}
+	index, err := strconv.Atoi(s[i+1 : j])
+	if err != nil {
+		return 0, 0
+	}
+	return index, j - i
+}
+
+// queryParamIndexes returns the indexes of the $N used by script outside of
+// quotes and comments.
+func queryParamIndexes(script string) map[int]bool {
+	ret := map[int]bool{}
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			i = j
+			continue
+		}
+		if index, n := matchQueryParam(script, i); n > 0 {
+			ret[index] = true
+			i += n
+			continue
+		}
+		i++
+	}
+	return ret
+}
+
+func sameIdentifierRule(a, b *IdentifierRule) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type != b.Type || len(a.Values) != len(b.Values) {
+		return false
+	}
+	for i := range a.Values {
+		if a.Values[i] != b.Values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// substituteQueryParams replaces the $0, $1... of script that have an
+// identifier rule with the value of their query param, which must be on the
+// allow-list of the rule. Identifiers are backtick quoted, keywords used as
+// listed. The $N without a rule are left to bindQueryParamValues.
+func substituteQueryParams(script string, queryParams []string, rules map[string]*IdentifierRule) (string, error) {
+	if len(rules) == 0 {
+		return script, nil
+	}
+	replacements := map[int]string{}
+	for i, v := range queryParams {
+		rule := rules[strconv.Itoa(i)]
+		if rule == nil {
+			continue
+		}
+		allowed := ""
+		for _, value := range rule.Values {
+			if strings.EqualFold(value, strings.TrimSpace(v)) {
+				allowed = value
+				break
+			}
+		}
+		if allowed == "" {
+			return "", errors.New(fmt.Sprint("Query param $", i, ": ", v, " is not allowed."))
+		}
+		if rule.Type == "keyword" {
+			replacements[i] = allowed
+		} else {
+			replacements[i] = quoteIdentifier(allowed)
+		}
+	}
+
+	var ret []byte
+	for i := 0; i < len(script); {
+		if j := skipSqlQuoted(script, i); j > i {
+			ret = append(ret, script[i:j]...)
+			i = j
+			continue
+		}
+		if index, n := matchQueryParam(script, i); n > 0 && rules[strconv.Itoa(index)] != nil {
+			replacement, ok := replacements[index]
+			if !ok {
+				return "", errors.New(fmt.Sprint("Query param $", index, " is missing."))
+			}
+			ret = append(ret, replacement...)
+			i += n
+			continue
+		}
+		ret = append(ret, script[i])
+		i++
+	}
+	return string(ret), nil
+}
+
+// bindQueryParamValues binds the $N of a statement without an identifier
+// rule as values: each becomes a ? and its query param is merged into args
+// at the right position, like context placeholders. Such a $N can only
+// stand for a value, never for a name or a piece of SQL.
+func bindQueryParamValues(script string, args []interface{}, queryParams []string, rules map[string]*IdentifierRule) (string, []interface{}, error) {
+	if !strings.Contains(script, "$") {
+		return script, args, nil
+	}
+	missing := -1
+	script, args = bindPlaceholders(script, args, func(s string, i int) (int, interface{}) {
+		index, n := matchQueryParam(s, i)
+		if n == 0 || rules[strconv.Itoa(index)] != nil {
+			return 0, nil
+		}
+		if index >= len(queryParams) {
+			missing = index
+			return 0, nil
+		}
+		return n, queryParams[index]
+	})
+	if missing >= 0 {
+		return "", nil, errors.New(fmt.Sprint("Query param $", missing, " is missing."))
+	}
+	return script, args, nil
+}
+
+// bindQueryIdentifiers substitutes the $N query params of a stored query
+// that have an identifier rule.
+func bindQueryIdentifiers(query map[string]string, script string, queryParams []string) (string, error) {
+	rules, err := parseIdentifierRules(query["identifiers"])
+	if err != nil {
+		return "", err
+	}
+	return substituteQueryParams(script, queryParams, rules)
+}
+
+// bindQueryValues binds the remaining $N query params of a stored query
+// statement as values, once its positional args are known.
+func bindQueryValues(query map[string]string, script string, args []interface{}, queryParams []string) (string, []interface{}, error) {
+	rules, err := parseIdentifierRules(query["identifiers"])
+	if err != nil {
+		return "", nil, err
+	}
+	return bindQueryParamValues(script, args, queryParams, rules)
+}
+
+// quoteIdentifier quotes a possibly qualified name like table.column.
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.Replace(part, "`", "``", -1) + "`"
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,216 @@
+// query_params_test
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseQueryParams(t *testing.T) {
+	var cases = []struct {
+		schema string
+		names  []string
+		types  []string
+		err    bool
+	}{
+		{"", nil, nil, false},
+		{"  ", nil, nil, false},
+		{`[]`, []string{}, []string{}, false},
+		{`[{"name":"id","type":"int"},{"name":"q"}]`, []string{"id", "q"}, []string{"int", "string"}, false},
+		{`[{"name":"at","type":"datetime","required":true}]`, []string{"at"}, []string{"datetime"}, false},
+		{`[{"name":"_x1","type":"bool"}]`, []string{"_x1"}, []string{"bool"}, false},
+		{`[{"name":"id"},{"name":"id"}]`, nil, nil, true},
+		{`[{"name":"1id"}]`, nil, nil, true},
+		{`[{"name":""}]`, nil, nil, true},
+		{`[{"name":"a-b"}]`, nil, nil, true},
+		{`[{"name":"id","type":"blob"}]`, nil, nil, true},
+		{`{"name":"id"}`, nil, nil, true},
+		{`not json`, nil, nil, true},
+	}
+	for _, c := range cases {
+		defs, err := parseQueryParams(c.schema)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseQueryParams(%q) expected an error", c.schema)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseQueryParams(%q) unexpected error: %v", c.schema, err)
+			continue
+		}
+		if len(defs) != len(c.names) {
+			t.Errorf("parseQueryParams(%q) got %d params, expected %d", c.schema, len(defs), len(c.names))
+			continue
+		}
+		for i, def := range defs {
+			if def.Name != c.names[i] || def.Type != c.types[i] {
+				t.Errorf("parseQueryParams(%q)[%d] got %s %s, expected %s %s", c.schema, i, def.Name, def.Type, c.names[i], c.types[i])
+			}
+		}
+	}
+}
+
+func TestResolveQueryParams(t *testing.T) {
+	defs, err := parseQueryParams(`[{"name":"id","type":"int","required":true},
+		{"name":"q","max_length":3},{"name":"on","type":"bool","default":true}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		params []interface{}
+		values map[string]interface{}
+		err    bool
+	}{
+		{[]interface{}{float64(1), "ab"}, map[string]interface{}{"id": int64(1), "q": "ab", "on": true}, false},
+		{[]interface{}{map[string]interface{}{"id": "7", "on": "false"}}, map[string]interface{}{"id": int64(7), "q": nil, "on": false}, false},
+		{[]interface{}{}, nil, true},
+		{[]interface{}{float64(1.5)}, nil, true},
+		{[]interface{}{float64(1), "abcd"}, nil, true},
+		{[]interface{}{float64(1), "a", true, "extra"}, nil, true},
+		{[]interface{}{map[string]interface{}{"id": float64(1), "other": "x"}}, nil, true},
+	}
+	for i, c := range cases {
+		values, err := resolveQueryParams(defs, c.params)
+		if c.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		for k, v := range c.values {
+			if values[k] != v {
+				t.Errorf("case %d: %s got %v, expected %v", i, k, values[k], v)
+			}
+		}
+	}
+}
+
+func TestBindNamedParams(t *testing.T) {
+	defs, err := parseQueryParams(`[{"name":"id","type":"int"},{"name":"q"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{"id": int64(1), "q": "x"}
+	var cases = []struct {
+		script   string
+		expected string
+		args     int
+		err      bool
+	}{
+		{"SELECT * FROM t WHERE ID=:id AND NAME=:q", "SELECT * FROM t WHERE ID=? AND NAME=?", 2, false},
+		{"SELECT ':id', `:q` FROM t -- :id\nWHERE ID=:id", "SELECT ':id', `:q` FROM t -- :id\nWHERE ID=?", 1, false},
+		{"SELECT DATE(NOW()), :id", "SELECT DATE(NOW()), ?", 1, false},
+		{"SELECT * FROM t WHERE ID=:other", "", 0, true},
+		{"SELECT * FROM t WHERE ID=? AND NAME=:q", "", 0, true},
+	}
+	for _, c := range cases {
+		script, args, err := bindNamedParams(c.script, defs, values)
+		if c.err {
+			if err == nil {
+				t.Errorf("bindNamedParams(%q) expected an error", c.script)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("bindNamedParams(%q) unexpected error: %v", c.script, err)
+			continue
+		}
+		if script != c.expected || len(args) != c.args {
+			t.Errorf("bindNamedParams(%q) got %q %v, expected %q with %d args", c.script, script, args, c.expected, c.args)
+		}
+	}
+}
+
+func TestBindQueryParams(t *testing.T) {
+	query := map[string]string{"params": `[{"name":"id","type":"int","required":true},
+		{"name":"at","type":"datetime"},{"name":"limit","type":"int","default":10}]`}
+	script := "SELECT * FROM t WHERE ID=:id AND (:at IS NULL OR CREATE_TIME>:at) LIMIT :limit"
+
+	t.Run("binds by name in script order", func(t *testing.T) {
+		params := []interface{}{map[string]interface{}{"id": "7", "at": "2016-01-02"}}
+		s, args, err := bindQueryParams(query, script, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != "SELECT * FROM t WHERE ID=? AND (? IS NULL OR CREATE_TIME>?) LIMIT ?" {
+			t.Fatalf("got %q", s)
+		}
+		at := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+		if len(args) != 4 || args[0] != int64(7) || args[1] != at || args[2] != at || args[3] != int64(10) {
+			t.Fatalf("got %v", args)
+		}
+	})
+
+	t.Run("reports every invalid param", func(t *testing.T) {
+		params := []interface{}{map[string]interface{}{"at": "yesterday", "other": 1}}
+		_, _, err := bindQueryParams(query, script, params)
+		paramErrors, ok := err.(ParamErrors)
+		if !ok || len(paramErrors) != 3 {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("leaves queries without a schema alone", func(t *testing.T) {
+		params := []interface{}{"1"}
+		s, args, err := bindQueryParams(map[string]string{}, "SELECT * FROM t WHERE ID=?", params)
+		if err != nil || s != "SELECT * FROM t WHERE ID=?" || len(args) != 1 || args[0] != "1" {
+			t.Fatalf("got %q %v %v", s, args, err)
+		}
+	})
+}
+
+func TestSubstituteQueryParams(t *testing.T) {
+	rules, err := parseIdentifierRules(`{"0":{"values":["NAME","t.CREATE_TIME"]},"1":{"type":"keyword","values":["ASC","DESC"]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		script      string
+		queryParams []string
+		rules       map[string]*IdentifierRule
+		expected    string
+		args        []interface{}
+		err         bool
+	}{
+		{"SELECT * FROM t ORDER BY $0 $1", []string{"t.create_time", "desc"}, rules, "SELECT * FROM t ORDER BY `t`.`CREATE_TIME` DESC", nil, false},
+		{"SELECT '$0' FROM t ORDER BY $0", []string{"NAME"}, rules, "SELECT '$0' FROM t ORDER BY `NAME`", nil, false},
+		{"SELECT * FROM t WHERE A=$2 ORDER BY $0", []string{"NAME", "ASC", "x"}, rules, "SELECT * FROM t WHERE A=? ORDER BY `NAME`", []interface{}{"x"}, false},
+		{"SELECT * FROM t ORDER BY $0", []string{"ID"}, rules, "", nil, true},
+		{"SELECT * FROM t ORDER BY $0 $1", []string{"NAME", "ASC; DROP TABLE t"}, rules, "", nil, true},
+		{"SELECT * FROM t ORDER BY $0 $2", []string{"NAME"}, rules, "", nil, true},
+		{"SELECT * FROM t ORDER BY $1", []string{"NAME"}, rules, "", nil, true},
+		{"SELECT * FROM t WHERE CREATOR_ID=$0", []string{"CREATOR_ID"}, nil, "SELECT * FROM t WHERE CREATOR_ID=?", []interface{}{"CREATOR_ID"}, false},
+		{"SELECT * FROM t WHERE ID='$0' AND NAME LIKE '%$1%'", []string{"x' OR '1'='1", "a"}, nil,
+			"SELECT * FROM t WHERE ID=? AND NAME LIKE CONCAT('%',?,'%')", []interface{}{"x' OR '1'='1", "a"}, false},
+		{"SELECT * FROM t WHERE A=$10 AND B=$1", []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, nil,
+			"SELECT * FROM t WHERE A=? AND B=?", []interface{}{"10", "1"}, false},
+		{"SELECT price$1 FROM t WHERE A=$0", []string{"a", "b"}, nil, "SELECT price$1 FROM t WHERE A=?", []interface{}{"a"}, false},
+		{"SELECT * FROM t WHERE ID=$1", []string{"1"}, nil, "", nil, true},
+	}
+	for _, c := range cases {
+		script, err := substituteQueryParams(c.script, c.queryParams, c.rules)
+		var args []interface{}
+		if err == nil {
+			script, args, err = bindQueryParamValues(script, nil, c.queryParams, c.rules)
+		}
+		if c.err {
+			if err == nil {
+				t.Errorf("%q with %q expected an error, got %q", c.script, c.queryParams, script)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q with %q unexpected error: %v", c.script, c.queryParams, err)
+			continue
+		}
+		if script != c.expected || fmt.Sprint(args) != fmt.Sprint(c.args) {
+			t.Errorf("%q with %q got %q %v, expected %q %v", c.script, c.queryParams, script, args, c.expected, c.args)
+		}
+	}
+}
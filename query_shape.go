@@ -0,0 +1,222 @@
+// query_shape
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryShape is read from the SHAPE column of a query. Types converts
+// column values from strings to int, float, bool, json or datetime. The
+// rest describes how flat joined rows are grouped into nested objects:
+//
+//	{"types": {"ID": "int", "QTY": "int"},
+//	 "key": ["ID"], "fields": ["ID", "CUSTOMER"],
+//	 "nested": {"items": {"key": ["ITEM_ID"], "fields": ["ITEM_ID", "QTY"]}}}
+//
+// Rows with equal key values are merged into one object, each nested node
+// collects the rows of its parent into an array, or a single object with
+// single set. Without fields a node takes all columns not claimed by its
+// nested nodes. Column names are matched case insensitively.
+type QueryShape struct {
+	Types map[string]string `json:"types"`
+	*ShapeNode
+}
+
+type ShapeNode struct {
+	Key    []string              `json:"key"`
+	Fields []string              `json:"fields"`
+	Single bool                  `json:"single"`
+	Nested map[string]*ShapeNode `json:"nested"`
+}
+
+var shapeTypes = map[string]bool{
+	"string": true, "int": true, "float": true, "bool": true, "json": true, "datetime": true,
+}
+
+func parseQueryShape(schema string) (*QueryShape, error) {
+	if strings.TrimSpace(schema) == "" {
+		return nil, nil
+	}
+	shape := &QueryShape{}
+	err := json.Unmarshal([]byte(schema), shape)
+	if err != nil {
+		return nil, errors.New("Invalid shape: " + err.Error())
+	}
+	types := map[string]string{}
+	for column, t := range shape.Types {
+		if !shapeTypes[t] {
+			return nil, errors.New(fmt.Sprint("Invalid shape type: ", column, ": ", t))
+		}
+		types[strings.ToUpper(column)] = t
+	}
+	shape.Types = types
+	if shape.ShapeNode == nil {
+		shape.ShapeNode = &ShapeNode{}
+	}
+	return shape, nil
+}
+
+// Apply converts and groups the rows of a query result.
+func (this *QueryShape) Apply(rows []map[string]string) []map[string]interface{} {
+	return this.ShapeNode.apply(rows, this.Types)
+}
+
+func (this *ShapeNode) apply(rows []map[string]string, types map[string]string) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	groups := map[string]int{}
+	groupRows := [][]map[string]string{}
+	for _, row := range rows {
+		if len(this.Key) == 0 {
+			ret = append(ret, this.object(row, types))
+			groupRows = append(groupRows, []map[string]string{row})
+			continue
+		}
+		values := []string{}
+		empty := true
+		for _, key := range this.Key {
+			value := shapeValue(row, key)
+			if value != "" {
+				empty = false
+			}
+			values = append(values, value)
+		}
+		if empty {
+			// the outer join found nothing for this level
+			continue
+		}
+		groupKey := strings.Join(values, "\x00")
+		i, ok := groups[groupKey]
+		if !ok {
+			i = len(ret)
+			groups[groupKey] = i
+			ret = append(ret, this.object(row, types))
+			groupRows = append(groupRows, nil)
+		}
+		groupRows[i] = append(groupRows[i], row)
+	}
+	for name, nested := range this.Nested {
+		for i, obj := range ret {
+			children := nested.apply(groupRows[i], types)
+			if nested.Single {
+				if len(children) > 0 {
+					obj[name] = children[0]
+				} else {
+					obj[name] = nil
+				}
+			} else {
+				obj[name] = children
+			}
+		}
+	}
+	return ret
+}
+
+func (this *ShapeNode) object(row map[string]string, types map[string]string) map[string]interface{} {
+	obj := map[string]interface{}{}
+	if len(this.Fields) > 0 {
+		for _, field := range this.Fields {
+			for column, value := range row {
+				if strings.EqualFold(column, field) {
+					obj[column] = convertShapeValue(value, types[strings.ToUpper(column)])
+					break
+				}
+			}
+		}
+		return obj
+	}
+	claimed := map[string]bool{}
+	this.claimedFields(claimed, false)
+	for column, value := range row {
+		if !claimed[strings.ToUpper(column)] {
+			obj[column] = convertShapeValue(value, types[strings.ToUpper(column)])
+		}
+	}
+	return obj
+}
+
+// claimedFields collects the fields of the nested nodes, which are left out
+// of nodes without explicit fields.
+func (this *ShapeNode) claimedFields(claimed map[string]bool, self bool) {
+	if self {
+		for _, field := range this.Fields {
+			claimed[strings.ToUpper(field)] = true
+		}
+	}
+	for _, nested := range this.Nested {
+		nested.claimedFields(claimed, true)
+	}
+}
+
+func shapeValue(row map[string]string, column string) string {
+	if value, ok := row[column]; ok {
+		return value
+	}
+	for k, value := range row {
+		if strings.EqualFold(k, column) {
+			return value
+		}
+	}
+	return ""
+}
+
+// convertShapeValue converts a column value to its declared type. Empty
+// values of non string columns become null, values that fail to convert are
+// kept as strings.
+func convertShapeValue(value string, t string) interface{} {
+	if t == "" || t == "string" {
+		return value
+	}
+	if value == "" {
+		return nil
+	}
+	switch t {
+	case "int":
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return v
+		}
+	case "float":
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	case "bool":
+		if v, err := strconv.ParseBool(value); err == nil {
+			return v
+		}
+	case "json":
+		if json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
+	case "datetime":
+		for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05.999999", "2006-01-02"} {
+			if v, err := time.Parse(layout, value); err == nil {
+				return v.Format(time.RFC3339Nano)
+			}
+		}
+	}
+	return value
+}
+
+// QueryShaped runs a stored query like QueryMap and applies its shape.
+func (this *NdDataOperator) QueryShaped(tableId string, params []interface{}, queryParams []string, context map[string]interface{}) ([]map[string]interface{}, error) {
+	query, err := loadQuery(context["app_id"].(string), tableId)
+	if err != nil {
+		return nil, err
+	}
+	shape, err := parseQueryShape(query["shape"])
+	if err != nil {
+		return nil, err
+	}
+	m, err := this.QueryMap(tableId, params, queryParams, context)
+	if err != nil {
+		return nil, err
+	}
+	if shape == nil {
+		shape = &QueryShape{ShapeNode: &ShapeNode{}}
+	}
+	return shape.Apply(m), nil
+}
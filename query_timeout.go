@@ -0,0 +1,186 @@
+// query_timeout
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elgs/gorest2"
+)
+
+// queryTx is a transaction bound to the context of an HTTP request and a
+// statement timeout. When the context is done before the transaction ends,
+// the statement running on its connection is killed on the server, so the
+// connection is not kept busy after the client went away. The connection is
+// pinned for the life of the transaction, so the kill cannot hit anybody
+// else, and it is closed rather than pooled once a kill was sent.
+type queryTx struct {
+	*sql.Tx
+	ctx     context.Context
+	cancel  context.CancelFunc
+	conn    *sql.Conn
+	killed  bool
+	done    chan struct{}
+	stopped chan struct{}
+	once    *sync.Once
+	// parent is set on the share of a batch transaction, whose commit and
+	// rollback are left to the batch. written and outbox collect the tables
+	// the shares wrote to and the events they raised.
+	parent  *queryTx
+	written []string
+	outbox  []string
+}
+
+// beginGuardedTx begins a transaction on db under parent, which may be nil,
+// limited to timeout when it is positive.
+func beginGuardedTx(parent context.Context, timeout time.Duration, db *sql.DB, opts *sql.TxOptions) (*queryTx, error) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		conn.Close()
+		cancel()
+		return nil, err
+	}
+	ret := &queryTx{
+		Tx:      tx,
+		ctx:     ctx,
+		cancel:  cancel,
+		conn:    conn,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	var connectionId int64
+	err = tx.QueryRow("SELECT CONNECTION_ID()").Scan(&connectionId)
+	if err != nil {
+		tx.Rollback()
+		conn.Close()
+		cancel()
+		return nil, ret.queryError(err)
+	}
+	go func() {
+		defer close(ret.stopped)
+		select {
+		case <-ctx.Done():
+			ret.killed = true
+			_, err := db.Exec(fmt.Sprint("KILL QUERY ", connectionId))
+			if err != nil {
+				fmt.Println(err)
+			}
+		case <-ret.done:
+		}
+	}()
+	return ret, nil
+}
+
+// share returns a handle on the transaction for one item of a batch.
+func (this *queryTx) share() *queryTx {
+	return &queryTx{Tx: this.Tx, ctx: this.ctx, parent: this}
+}
+
+// release stops the watchdog before the transaction ends.
+func (this *queryTx) release() {
+	this.once.Do(func() {
+		close(this.done)
+		<-this.stopped
+	})
+}
+
+// closeConn gives up the pinned connection once the transaction is over. A
+// connection a kill was sent to is discarded, as the kill may still be
+// pending on it.
+func (this *queryTx) closeConn() {
+	if this.killed {
+		this.conn.Raw(func(driverConn interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	this.conn.Close()
+	this.cancel()
+}
+
+func (this *queryTx) Commit() error {
+	if this.parent != nil {
+		return nil
+	}
+	this.release()
+	defer this.closeConn()
+	return this.queryError(this.Tx.Commit())
+}
+
+func (this *queryTx) Rollback() error {
+	if this.parent != nil {
+		return nil
+	}
+	this.release()
+	defer this.closeConn()
+	return this.Tx.Rollback()
+}
+
+// queryError replaces the error of a killed statement with a clear one.
+func (this *queryTx) queryError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch this.ctx.Err() {
+	case context.DeadlineExceeded:
+		return errors.New("Query timed out.")
+	case context.Canceled:
+		return errors.New("Query canceled.")
+	}
+	return err
+}
+
+// queryTimeout is the TIMEOUT of a query in seconds, or the QUERY_TIMEOUT
+// of its project when the query has none.
+func queryTimeout(query map[string]string, dbo gorest2.DataOperator) time.Duration {
+	if timeout, err := parseQueryTimeout(query["timeout"]); err == nil && timeout > 0 {
+		return timeout
+	}
+	return projectQueryTimeout(dbo)
+}
+
+func projectQueryTimeout(dbo gorest2.DataOperator) time.Duration {
+	if ndDbo, ok := dbo.(*NdDataOperator); ok {
+		return ndDbo.QueryTimeout()
+	}
+	return 0
+}
+
+func parseQueryTimeout(v interface{}) (time.Duration, error) {
+	if v == nil || fmt.Sprint(v) == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.New(fmt.Sprint("Invalid timeout: ", v))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// requestContext is the context of the HTTP request a stored query is run
+// for, when it is known.
+func requestContext(ndContext map[string]interface{}) context.Context {
+	ctx, _ := ndContext["request_ctx"].(context.Context)
+	return ctx
+}
@@ -0,0 +1,187 @@
+// query_timeout_test
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elgs/gorest2"
+)
+
+// killDriver is a database driver whose SLEEP statements run until the
+// connection they run on gets a KILL QUERY. sleeping tells when one starts.
+type killDriver struct {
+	mutex    *sync.Mutex
+	nextId   int
+	kills    map[int]chan struct{}
+	killed   []int
+	sleeping chan struct{}
+}
+
+var testKillDriver = &killDriver{
+	mutex:    &sync.Mutex{},
+	kills:    map[int]chan struct{}{},
+	sleeping: make(chan struct{}, 1),
+}
+
+func init() {
+	sql.Register("nd_kill_test", testKillDriver)
+}
+
+func (this *killDriver) Open(name string) (driver.Conn, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.nextId++
+	this.kills[this.nextId] = make(chan struct{})
+	return &killConn{driver: this, id: this.nextId}, nil
+}
+
+func (this *killDriver) kill(id int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.killed = append(this.killed, id)
+	if kill, ok := this.kills[id]; ok {
+		close(kill)
+		delete(this.kills, id)
+	}
+}
+
+func (this *killDriver) wasKilled(id int) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, killed := range this.killed {
+		if killed == id {
+			return true
+		}
+	}
+	return false
+}
+
+type killConn struct {
+	driver *killDriver
+	id     int
+}
+
+func (this *killConn) Prepare(query string) (driver.Stmt, error) {
+	return &killStmt{conn: this, query: query}, nil
+}
+func (this *killConn) Close() error              { return nil }
+func (this *killConn) Begin() (driver.Tx, error) { return this, nil }
+func (this *killConn) Commit() error             { return nil }
+func (this *killConn) Rollback() error           { return nil }
+
+type killStmt struct {
+	conn  *killConn
+	query string
+}
+
+func (this *killStmt) Close() error  { return nil }
+func (this *killStmt) NumInput() int { return -1 }
+
+func (this *killStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(this.query, "KILL QUERY ") {
+		id, err := strconv.Atoi(strings.TrimPrefix(this.query, "KILL QUERY "))
+		if err != nil {
+			return nil, err
+		}
+		this.conn.driver.kill(id)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (this *killStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case this.query == "SELECT CONNECTION_ID()":
+		return &killRows{values: []driver.Value{int64(this.conn.id)}}, nil
+	case strings.HasPrefix(this.query, "SELECT SLEEP"):
+		this.conn.driver.mutex.Lock()
+		kill := this.conn.driver.kills[this.conn.id]
+		this.conn.driver.mutex.Unlock()
+		this.conn.driver.sleeping <- struct{}{}
+		select {
+		case <-kill:
+			return nil, errors.New("Query execution was interrupted")
+		case <-time.After(5 * time.Second):
+			return &killRows{values: []driver.Value{int64(0)}}, nil
+		}
+	}
+	return nil, errors.New("unexpected query: " + this.query)
+}
+
+type killRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (this *killRows) Columns() []string { return []string{"v"} }
+func (this *killRows) Close() error      { return nil }
+func (this *killRows) Next(dest []driver.Value) error {
+	if this.done {
+		return io.EOF
+	}
+	this.done = true
+	copy(dest, this.values)
+	return nil
+}
+
+func TestApiRequestCancelKillsQuery(t *testing.T) {
+	db, err := sql.Open("nd_kill_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	getDbo := gorest2.GetDbo
+	defer func() { gorest2.GetDbo = getDbo }()
+	gorest2.GetDbo = func(id string) gorest2.DataOperator {
+		return &NdDataOperator{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/api/slow_query", nil).WithContext(ctx)
+	r.Header.Set("app_id", "p1")
+	_, _, apiContext, err := buildApiRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := beginGuardedTx(requestContext(apiContext), 0, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connectionId int
+	err = tx.QueryRow("SELECT CONNECTION_ID()").Scan(&connectionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		rows, err := tx.Query("SELECT SLEEP(10)")
+		if err == nil {
+			rows.Close()
+		}
+		done <- tx.queryError(err)
+	}()
+	<-testKillDriver.sleeping
+	cancel()
+	select {
+	case err = <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("query still running after the request was canceled")
+	}
+	tx.Rollback()
+	if err == nil || err.Error() != "Query canceled." {
+		t.Errorf("got %v, expected the query to be canceled", err)
+	}
+	if !testKillDriver.wasKilled(connectionId) {
+		t.Errorf("connection %d was not killed", connectionId)
+	}
+}
@@ -0,0 +1,91 @@
+// query_tx
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/elgs/gosqljson"
+)
+
+var isolationLevels = map[string]sql.IsolationLevel{
+	"READ UNCOMMITTED": sql.LevelReadUncommitted,
+	"READ COMMITTED":   sql.LevelReadCommitted,
+	"REPEATABLE READ":  sql.LevelRepeatableRead,
+	"SERIALIZABLE":     sql.LevelSerializable,
+}
+
+// parseQueryTxOptions reads the ISOLATION_LEVEL and READ_ONLY columns of a
+// query. A nil result means the defaults: reads run outside of a
+// transaction and writes in one with the isolation level of the server.
+func parseQueryTxOptions(isolation, readOnly string) (*sql.TxOptions, error) {
+	isolation = strings.ToUpper(strings.Join(strings.Fields(strings.Replace(isolation, "_", " ", -1)), " "))
+	readOnly = strings.ToLower(strings.TrimSpace(readOnly))
+	if isolation == "" && (readOnly == "" || readOnly == "0" || readOnly == "false") {
+		return nil, nil
+	}
+	opts := &sql.TxOptions{}
+	if isolation != "" {
+		level, ok := isolationLevels[isolation]
+		if !ok {
+			return nil, errors.New("Invalid isolation level: " + isolation)
+		}
+		opts.Isolation = level
+	}
+	switch readOnly {
+	case "", "0", "false":
+	case "1", "true":
+		opts.ReadOnly = true
+	default:
+		return nil, errors.New("Invalid read only flag: " + readOnly)
+	}
+	return opts, nil
+}
+
+// queryMap runs the prepared query in the transaction of its batch, or in a
+// transaction of its own when the query asks for an isolation level or to
+// be read only, or has to be canceled with its request or on timeout.
+func (this *preparedQuery) queryMap(c string, script string, args ...interface{}) ([]map[string]string, error) {
+	if this.Tx != nil {
+		m, err := gosqljson.QueryTxToMap(this.Tx.Tx, c, script, args...)
+		return m, this.Tx.queryError(err)
+	}
+	if !this.guarded() {
+		return gosqljson.QueryDbToMap(this.Db, c, script, args...)
+	}
+	tx, err := beginGuardedTx(this.Ctx, this.Timeout, this.Db, this.TxOptions)
+	if err != nil {
+		return nil, err
+	}
+	m, err := gosqljson.QueryTxToMap(tx.Tx, c, script, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, tx.queryError(err)
+	}
+	return m, tx.Commit()
+}
+
+func (this *preparedQuery) queryArray(c string, script string, args ...interface{}) ([]string, [][]string, error) {
+	if this.Tx != nil {
+		h, a, err := gosqljson.QueryTxToArray(this.Tx.Tx, c, script, args...)
+		return h, a, this.Tx.queryError(err)
+	}
+	if !this.guarded() {
+		return gosqljson.QueryDbToArray(this.Db, c, script, args...)
+	}
+	tx, err := beginGuardedTx(this.Ctx, this.Timeout, this.Db, this.TxOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, a, err := gosqljson.QueryTxToArray(tx.Tx, c, script, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, tx.queryError(err)
+	}
+	return h, a, tx.Commit()
+}
+
+func (this *preparedQuery) guarded() bool {
+	return this.TxOptions != nil || this.Ctx != nil || this.Timeout > 0
+}
@@ -0,0 +1,205 @@
+// query_versions
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elgs/gorest2"
+	"github.com/elgs/gosqljson"
+	"github.com/satori/go.uuid"
+)
+
+func splitQueryVersion(queryName string) (string, string) {
+	i := strings.LastIndex(queryName, "@")
+	if i < 0 {
+		return queryName, ""
+	}
+	return queryName[:i], queryName[i+1:]
+}
+
+// createQueryVersion snapshots the current definition of a query as a new
+// immutable version and makes it the active one. Nothing is created when the
+// definition did not change. The query row is locked for the transaction,
+// so concurrent saves and rollbacks of a query number their versions one
+// after the other.
+func createQueryVersion(db *sql.DB, queryId string, context map[string]interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = createQueryVersionTx(tx, queryId, context)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func createQueryVersionTx(tx *sql.Tx, queryId string, context map[string]interface{}) error {
+	queryData, err := gosqljson.QueryTxToMap(tx, "upper", "SELECT * FROM query WHERE ID=? FOR UPDATE", queryId)
+	if err != nil {
+		return err
+	}
+	if len(queryData) == 0 {
+		return errors.New("Query not found.")
+	}
+	queryRow := queryData[0]
+
+	if queryRow["ACTIVE_VERSION"] != "" && queryRow["ACTIVE_VERSION"] != "0" {
+		activeData, err := gosqljson.QueryTxToMap(tx, "upper",
+			"SELECT * FROM query_version WHERE QUERY_ID=? AND VERSION=?", queryId, queryRow["ACTIVE_VERSION"])
+		if err != nil {
+			return err
+		}
+		if len(activeData) == 1 {
+			changed := false
+			for _, field := range queryFields {
+				if activeData[0][field] != queryRow[field] {
+					changed = true
+					break
+				}
+			}
+			if !changed {
+				return nil
+			}
+		}
+	}
+
+	versionData, err := gosqljson.QueryTxToMap(tx, "",
+		"SELECT IFNULL(MAX(VERSION),0)+1 AS VERSION FROM query_version WHERE QUERY_ID=?", queryId)
+	if err != nil {
+		return err
+	}
+	version := versionData[0]["VERSION"]
+
+	var userId, userCode string
+	if userToken, ok := context["user_token"].(map[string]string); ok {
+		userId = userToken["ID"]
+		userCode = userToken["EMAIL"]
+	}
+	queryVersion := map[string]interface{}{
+		"ID":           strings.Replace(uuid.NewV4().String(), "-", "", -1),
+		"QUERY_ID":     queryId,
+		"PROJECT_ID":   queryRow["PROJECT_ID"],
+		"NAME":         queryRow["NAME"],
+		"VERSION":      version,
+		"CREATOR_ID":   userId,
+		"CREATOR_CODE": userCode,
+		"CREATE_TIME":  time.Now().UTC(),
+	}
+	for _, field := range queryFields {
+		queryVersion[field] = queryRow[field]
+	}
+	_, err = TxInsert(tx, "query_version", queryVersion, false, false)
+	if err != nil {
+		return err
+	}
+	_, err = gosqljson.ExecTx(tx, "UPDATE query SET ACTIVE_VERSION=? WHERE ID=?", version, queryId)
+	return err
+}
+
+// rollbackQuery makes an earlier version the active one and copies its
+// definition back into the query row.
+func rollbackQuery(db *sql.DB, queryRow map[string]string, version string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = gosqljson.QueryTxToMap(tx, "upper", "SELECT ID FROM query WHERE ID=? FOR UPDATE", queryRow["ID"])
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	versionData, err := gosqljson.QueryTxToMap(tx, "upper",
+		"SELECT * FROM query_version WHERE QUERY_ID=? AND VERSION=?", queryRow["ID"], version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(versionData) == 0 {
+		tx.Rollback()
+		return errors.New("Query version not found.")
+	}
+	data := map[string]interface{}{
+		"ACTIVE_VERSION": version,
+		"UPDATE_TIME":    time.Now().UTC(),
+	}
+	for _, field := range queryFields {
+		data[field] = versionData[0][field]
+	}
+	fields, values := GenerateFields(data)
+	values = append(values, queryRow["ID"])
+	_, err = gosqljson.ExecTx(tx, "UPDATE query SET "+fields+" WHERE ID=?", values...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return clearQueryCache(queryRow["PROJECT_ID"], queryRow["NAME"], false)
+}
+
+// clearQueryCache drops the cached active definition of a query and of the
+// queries including it, and the pinned versions as well when the query
+// itself is gone. A name remembered as not being a query is forgotten.
+func clearQueryCache(projectId, queryName string, pinned bool) error {
+	keys := []string{fmt.Sprint("query:", projectId, ":", queryName), missingQueryKey(projectId, queryName)}
+	if pinned {
+		keys = append(keys, gorest2.RedisLocal.Keys(fmt.Sprint("query:", projectId, ":", queryName, "@*")).Val()...)
+	}
+	err := gorest2.RedisMaster.Del(keys...).Err()
+	if err != nil {
+		return err
+	}
+	return clearQueryIncluders(projectId, queryName)
+}
+
+// diffLines returns a line based diff of a and b, each line prefixed with
+// "  ", "- " or "+ ".
+func diffLines(a, b string) []string {
+	as := strings.Split(a, "\n")
+	bs := strings.Split(b, "\n")
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ret := []string{}
+	i, j := 0, 0
+	for i < len(as) && j < len(bs) {
+		if as[i] == bs[j] {
+			ret = append(ret, "  "+as[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			ret = append(ret, "- "+as[i])
+			i++
+		} else {
+			ret = append(ret, "+ "+bs[j])
+			j++
+		}
+	}
+	for ; i < len(as); i++ {
+		ret = append(ret, "- "+as[i])
+	}
+	for ; j < len(bs); j++ {
+		ret = append(ret, "+ "+bs[j])
+	}
+	return ret
+}
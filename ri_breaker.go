@@ -0,0 +1,169 @@
+// ri_breaker
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elgs/gorest2"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultCoolDown         = 30 * time.Second
+)
+
+// riBreaker is the circuit breaker of a before remote interceptor, read
+// from its FAILURE_THRESHOLD, COOL_DOWN and FAIL_POLICY columns. After
+// FAILURE_THRESHOLD calls in a row fail to connect, time out or get a 5xx,
+// 5 by default and 0 to never open, the circuit opens and no calls are made
+// for COOL_DOWN seconds, 30 by default. After that the circuit is half
+// open: a single call goes through as a probe, while the others are still
+// refused, and it closes the circuit when it succeeds and opens it again
+// when it fails. Any call that succeeds closes it. FAIL_POLICY decides what
+// happens to the write while the endpoint is failing: closed, the default,
+// rejects it, open lets it through without the interceptor. Its state is
+// kept in redis, shared by all nodes.
+type riBreaker struct {
+	Id        string
+	Threshold int64
+	CoolDown  time.Duration
+	FailOpen  bool
+	// probing is set when this call is the probe of a half open circuit.
+	probing bool
+}
+
+func parseRiBreaker(id, threshold, coolDown, failPolicy string) (*riBreaker, error) {
+	breaker := &riBreaker{Id: id, Threshold: defaultFailureThreshold, CoolDown: defaultCoolDown}
+	if strings.TrimSpace(threshold) != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(threshold), 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.New(fmt.Sprint("Invalid failure threshold: ", threshold))
+		}
+		breaker.Threshold = n
+	}
+	d, err := parseQueryTimeout(coolDown)
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Invalid cool down: ", coolDown))
+	}
+	if d > 0 {
+		breaker.CoolDown = d
+	}
+	switch strings.ToLower(strings.TrimSpace(failPolicy)) {
+	case "", "closed":
+	case "open":
+		breaker.FailOpen = true
+	default:
+		return nil, errors.New(fmt.Sprint("Invalid fail policy: ", failPolicy))
+	}
+	return breaker, nil
+}
+
+func (this *riBreaker) openKey() string {
+	return "ri_open:" + this.Id
+}
+
+func (this *riBreaker) failuresKey() string {
+	return "ri_failures:" + this.Id
+}
+
+func (this *riBreaker) trippedKey() string {
+	return "ri_tripped:" + this.Id
+}
+
+func (this *riBreaker) probeKey() string {
+	return "ri_probe:" + this.Id
+}
+
+// isOpen tells whether the call must not be made. In a half open circuit
+// the first caller becomes the probe, for at most callTimeout.
+func (this *riBreaker) isOpen(callTimeout time.Duration) bool {
+	if this.Threshold == 0 || this.Id == "" {
+		return false
+	}
+	if gorest2.RedisLocal.Get(this.openKey()).Val() != "" {
+		return true
+	}
+	if gorest2.RedisLocal.Get(this.trippedKey()).Val() == "" {
+		return false
+	}
+	probing, err := gorest2.RedisMaster.SetNX(this.probeKey(), "1", callTimeout).Result()
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+	this.probing = probing
+	return !probing
+}
+
+func (this *riBreaker) success() {
+	if this.Threshold == 0 || this.Id == "" {
+		return
+	}
+	keys := []string{this.failuresKey(), this.trippedKey()}
+	if this.probing {
+		keys = append(keys, this.probeKey())
+	}
+	err := gorest2.RedisMaster.Del(keys...).Err()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// failure counts a failed call and opens the circuit at the threshold. The
+// count is left one short of it, so a failing probe after the cool down
+// opens the circuit again right away.
+func (this *riBreaker) failure() {
+	if this.Threshold == 0 || this.Id == "" {
+		return
+	}
+	defer this.release()
+	failures, err := gorest2.RedisMaster.Incr(this.failuresKey()).Result()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if failures < this.Threshold {
+		return
+	}
+	err = gorest2.RedisMaster.Set(this.openKey(), "1", this.CoolDown).Err()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = gorest2.RedisMaster.Set(this.trippedKey(), "1", 0).Err()
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = gorest2.RedisMaster.Set(this.failuresKey(), strconv.FormatInt(this.Threshold-1, 10), 0).Err()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// release lets another call probe the circuit, when this probe ended without
+// telling whether the endpoint is back.
+func (this *riBreaker) release() {
+	if !this.probing {
+		return
+	}
+	this.probing = false
+	err := gorest2.RedisMaster.Del(this.probeKey()).Err()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// failed applies the fail policy to a call that could not be made or did
+// not get an answer.
+func (this *riBreaker) failed(err error) (bool, error) {
+	if this.FailOpen {
+		fmt.Println("Remote interceptor", this.Id, "failed open:", err)
+		return true, nil
+	}
+	return false, err
+}
+
+var errRiUnavailable = errors.New("Remote interceptor unavailable.")
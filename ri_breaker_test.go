@@ -0,0 +1,57 @@
+// ri_breaker_test
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRiBreaker(t *testing.T) {
+	var cases = []struct {
+		threshold  string
+		coolDown   string
+		failPolicy string
+		expected   *riBreaker
+		err        bool
+	}{
+		{"", "", "", &riBreaker{Threshold: defaultFailureThreshold, CoolDown: defaultCoolDown}, false},
+		{"3", "60", "closed", &riBreaker{Threshold: 3, CoolDown: time.Minute}, false},
+		{" 0 ", "0.5", "OPEN", &riBreaker{Threshold: 0, CoolDown: 500 * time.Millisecond, FailOpen: true}, false},
+		{"", "0", "", &riBreaker{Threshold: defaultFailureThreshold, CoolDown: defaultCoolDown}, false},
+		{"-1", "", "", nil, true},
+		{"1.5", "", "", nil, true},
+		{"x", "", "", nil, true},
+		{"", "-5", "", nil, true},
+		{"", "soon", "", nil, true},
+		{"", "", "half", nil, true},
+	}
+	for _, c := range cases {
+		breaker, err := parseRiBreaker("ri", c.threshold, c.coolDown, c.failPolicy)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseRiBreaker(%q, %q, %q) expected an error", c.threshold, c.coolDown, c.failPolicy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRiBreaker(%q, %q, %q) unexpected error: %v", c.threshold, c.coolDown, c.failPolicy, err)
+			continue
+		}
+		if breaker.Threshold != c.expected.Threshold || breaker.CoolDown != c.expected.CoolDown || breaker.FailOpen != c.expected.FailOpen {
+			t.Errorf("parseRiBreaker(%q, %q, %q) got %+v, expected %+v", c.threshold, c.coolDown, c.failPolicy, breaker, c.expected)
+		}
+	}
+}
+
+func TestRiBreakerDisabled(t *testing.T) {
+	for _, breaker := range []*riBreaker{{Id: "ri", Threshold: 0}, {Id: "", Threshold: 5}} {
+		if breaker.isOpen(time.Second) {
+			t.Errorf("isOpen of %+v expected to be false", breaker)
+		}
+		breaker.failure()
+		breaker.success()
+		if breaker.probing {
+			t.Errorf("%+v expected not to probe", breaker)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	//	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/elgs/gorest2"
 )
@@ -20,18 +22,23 @@ type RiInterceptor struct {
 }
 
 func (this *RiInterceptor) commonAfterInterceptor(context map[string]interface{}, data map[string]interface{}) error {
+	id := ""
 	if oldData, found := context["old_data"].(map[string]string); found {
 		projectId := oldData["PROJECT_ID"]
 		target := oldData["TARGET"]
 		theType := oldData["TYPE"]
 		actionType := oldData["ACTION_TYPE"]
-		err := unloadRemoteInterceptor(projectId, target, theType, actionType)
+		id = oldData["ID"]
+		err := unloadRemoteInterceptor(projectId, target, theType, actionType, id)
 		if err != nil {
 			return err
 		}
 	}
 	if data != nil {
-		return loadRemoteInterceptor(data["PROJECT_ID"].(string), data["TARGET"].(string), data["TYPE"].(string), data["ACTION_TYPE"].(string))
+		if v, ok := data["ID"]; ok {
+			id = fmt.Sprint(v)
+		}
+		return loadRemoteInterceptor(id)
 	}
 	return nil
 }
@@ -46,7 +53,82 @@ func (this *RiInterceptor) AfterCreate(resourceId string, db *sql.DB, context ma
 	return nil
 }
 
+// riField is a column of a remote interceptor as sent by the client, which
+// may send numbers and booleans as JSON values rather than strings.
+func riField(data map[string]interface{}, field string) string {
+	if v, ok := data[field]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func checkRiSchema(data []map[string]interface{}) error {
+	for _, data1 := range data {
+		maxAttempts := riField(data1, "MAX_ATTEMPTS")
+		backoff := riField(data1, "BACKOFF")
+		statusCodes := riField(data1, "RETRY_STATUS_CODES")
+		_, err := parsePushRetryPolicy(maxAttempts, backoff, statusCodes)
+		if err != nil {
+			return err
+		}
+		if priority := strings.TrimSpace(riField(data1, "PRIORITY")); priority != "" {
+			if _, err := strconv.Atoi(priority); err != nil {
+				return errors.New(fmt.Sprint("Invalid priority: ", priority))
+			}
+		}
+		threshold := riField(data1, "FAILURE_THRESHOLD")
+		coolDown := riField(data1, "COOL_DOWN")
+		failPolicy := riField(data1, "FAIL_POLICY")
+		_, err = parseRiBreaker("", threshold, coolDown, failPolicy)
+		if err != nil {
+			return err
+		}
+		ri := map[string]string{}
+		for _, field := range riOptionFields {
+			ri[strings.ToLower(field)] = riField(data1, field)
+		}
+		_, err = parseRiOptions(ri, "", "")
+		if err != nil {
+			return err
+		}
+		if _, ok := data1["URL"]; ok {
+			err = egress.checkURL(riField(data1, "URL"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *RiInterceptor) BeforeCreate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	err := checkRiSchema(data)
+	if err != nil {
+		return false, err
+	}
+	for _, data1 := range data {
+		data1["SECRET"], err = generateRiSecret()
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 func (this *RiInterceptor) BeforeUpdate(resourceId string, db *sql.DB, context map[string]interface{}, data []map[string]interface{}) (bool, error) {
+	err := checkRiSchema(data)
+	if err != nil {
+		return false, err
+	}
+	for _, data1 := range data {
+		// an empty secret rotates it
+		if secret, ok := data1["SECRET"]; ok && (secret == nil || secret == "") {
+			data1["SECRET"], err = generateRiSecret()
+			if err != nil {
+				return false, err
+			}
+		}
+	}
 	context["load"] = true
 	return true, nil
 }
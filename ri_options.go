@@ -0,0 +1,130 @@
+// ri_options
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRiContentType    = "application/json"
+	defaultRiConnectTimeout = 10 * time.Second
+	defaultRiReadTimeout    = 30 * time.Second
+)
+
+// httpOptions tell httpRequest how to call a remote interceptor. They are
+// read from the HEADERS, AUTH_TYPE, AUTH_CREDENTIALS, CONTENT_TYPE,
+// CONNECT_TIMEOUT, READ_TIMEOUT, TLS_VERIFY and CA_CERT columns:
+//
+//	HEADERS           a JSON object of extra request headers
+//	AUTH_TYPE         bearer or basic, AUTH_CREDENTIALS is the token or
+//	                  user:password
+//	CONTENT_TYPE      application/json by default
+//	CONNECT_TIMEOUT   seconds to connect, 10 by default
+//	READ_TIMEOUT      seconds to wait for the response, 30 by default
+//	TLS_VERIFY        0 or false skips certificate verification, which is
+//	                  on by default; interceptors that existed before it
+//	                  was are migrated to 0
+//	CA_CERT           PEM certificates to verify the server with, instead
+//	                  of the system roots
+//
+// The same options apply to before-calls, after-calls and push delivery.
+type httpOptions struct {
+	Header         http.Header
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	TLSConfig      *tls.Config
+}
+
+// parseRiOptions builds the options from a remote interceptor with lower
+// case field names, as it is cached, and signs the call with its secret.
+func parseRiOptions(ri map[string]string, deliveryId, body string) (*httpOptions, error) {
+	opts := &httpOptions{
+		Header:         http.Header{},
+		ConnectTimeout: defaultRiConnectTimeout,
+		ReadTimeout:    defaultRiReadTimeout,
+		TLSConfig:      &tls.Config{},
+	}
+	if strings.TrimSpace(ri["headers"]) != "" {
+		headers := map[string]string{}
+		err := json.Unmarshal([]byte(ri["headers"]), &headers)
+		if err != nil {
+			return nil, errors.New("Invalid headers: " + err.Error())
+		}
+		for k, v := range headers {
+			opts.Header.Set(k, v)
+		}
+	}
+
+	credentials := ri["auth_credentials"]
+	switch strings.ToLower(strings.TrimSpace(ri["auth_type"])) {
+	case "":
+	case "bearer":
+		opts.Header.Set("Authorization", "Bearer "+credentials)
+	case "basic":
+		if !strings.Contains(credentials, ":") {
+			return nil, errors.New("Basic credentials must be user:password.")
+		}
+		opts.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	default:
+		return nil, errors.New(fmt.Sprint("Invalid auth type: ", ri["auth_type"]))
+	}
+
+	contentType := strings.TrimSpace(ri["content_type"])
+	if contentType == "" {
+		contentType = defaultRiContentType
+	}
+	opts.Header.Set("Content-Type", contentType)
+
+	timeout, err := parseQueryTimeout(ri["connect_timeout"])
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Invalid connect timeout: ", ri["connect_timeout"]))
+	}
+	if timeout > 0 {
+		opts.ConnectTimeout = timeout
+	}
+	timeout, err = parseQueryTimeout(ri["read_timeout"])
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Invalid read timeout: ", ri["read_timeout"]))
+	}
+	if timeout > 0 {
+		opts.ReadTimeout = timeout
+	}
+
+	switch strings.ToLower(strings.TrimSpace(ri["tls_verify"])) {
+	case "", "1", "true":
+	case "0", "false":
+		opts.TLSConfig.InsecureSkipVerify = true
+	default:
+		return nil, errors.New(fmt.Sprint("Invalid tls verify flag: ", ri["tls_verify"]))
+	}
+	if strings.TrimSpace(ri["ca_cert"]) != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ri["ca_cert"])) {
+			return nil, errors.New("Invalid CA certificate.")
+		}
+		opts.TLSConfig.RootCAs = pool
+	}
+
+	// set last, so custom headers cannot forge the signature or the test
+	// marker
+	opts.Header.Del(riTestHeader)
+	for k, v := range signRiRequest(ri["secret"], deliveryId, body) {
+		opts.Header[k] = v
+	}
+	return opts, nil
+}
+
+// riOptionFields are the columns of a remote interceptor that make its
+// http options.
+var riOptionFields = []string{
+	"HEADERS", "AUTH_TYPE", "AUTH_CREDENTIALS", "CONTENT_TYPE",
+	"CONNECT_TIMEOUT", "READ_TIMEOUT", "TLS_VERIFY", "CA_CERT",
+}
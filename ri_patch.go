@@ -0,0 +1,198 @@
+// ri_patch
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// riPatch lets a before remote interceptor change the data of the write it
+// approves. Next to query_params and params for its callback, the body of
+// the 200 response may hold a patch:
+//
+//	{"patch": {
+//	  "set":    {"COLUMN": value},      every row of create and update
+//	  "unset":  ["COLUMN"],             every row of create and update
+//	  "rows":   [{"COLUMN": value}],    one per row of create and update
+//	  "params": [[value]]               the params of exec
+//	}}
+//
+// Values are strings, numbers, booleans or null. rows must have as many
+// entries as there are rows, params as many rows of as many values as the
+// params they replace. The system columns filled in by netdata, ID,
+// PROJECT_ID and those of the creator and updater, cannot be patched. A
+// response without a patch changes nothing, an invalid patch rejects the
+// write. Interceptors run in order, and each sees
+// the data as patched by those before it.
+type riPatch struct {
+	Set    map[string]interface{}   `json:"set"`
+	Unset  []string                 `json:"unset"`
+	Rows   []map[string]interface{} `json:"rows"`
+	Params [][]interface{}          `json:"params"`
+}
+
+var riPatchSystemColumns = map[string]bool{
+	"ID":           true,
+	"PROJECT_ID":   true,
+	"CREATOR_ID":   true,
+	"CREATOR_CODE": true,
+	"CREATE_TIME":  true,
+	"UPDATER_ID":   true,
+	"UPDATER_CODE": true,
+	"UPDATE_TIME":  true,
+}
+
+// riPatchTarget is the data a patch applies to: the rows of create and
+// update, or the params of exec along with the payload data carrying them.
+type riPatchTarget struct {
+	Rows   []map[string]interface{}
+	Params *[][]interface{}
+	Data   map[string]interface{}
+}
+
+// parseRiPatch returns the patch of a response, or nil when there is none.
+func parseRiPatch(clientData string) (*riPatch, error) {
+	decoder := json.NewDecoder(strings.NewReader(clientData))
+	decoder.UseNumber()
+	response := map[string]json.RawMessage{}
+	if decoder.Decode(&response) != nil {
+		return nil, nil
+	}
+	raw, ok := response["patch"]
+	if !ok || string(raw) == "null" {
+		return nil, nil
+	}
+	decoder = json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	patch := &riPatch{}
+	err := decoder.Decode(patch)
+	if err != nil {
+		return nil, errors.New("Invalid patch: " + err.Error())
+	}
+	return patch, nil
+}
+
+func (this *riPatch) validate(target *riPatchTarget) error {
+	if target == nil {
+		return errors.New("Patch not supported for this action.")
+	}
+	if target.Params == nil {
+		if this.Params != nil {
+			return errors.New("Patch params only apply to exec.")
+		}
+		for k, v := range this.Set {
+			err := checkPatchValue(k, v)
+			if err != nil {
+				return err
+			}
+		}
+		for _, k := range this.Unset {
+			err := checkPatchColumn(k)
+			if err != nil {
+				return err
+			}
+		}
+		if this.Rows != nil {
+			if len(this.Rows) != len(target.Rows) {
+				return errors.New(fmt.Sprint("Patch rows expected: ", len(target.Rows)))
+			}
+			for _, row := range this.Rows {
+				for k, v := range row {
+					err := checkPatchValue(k, v)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	if this.Set != nil || this.Unset != nil || this.Rows != nil {
+		return errors.New("Only patch params apply to exec.")
+	}
+	if this.Params == nil {
+		return nil
+	}
+	params := *target.Params
+	if len(this.Params) != len(params) {
+		return errors.New(fmt.Sprint("Patch params rows expected: ", len(params)))
+	}
+	for i, row := range this.Params {
+		if len(row) != len(params[i]) {
+			return errors.New(fmt.Sprint("Patch params expected in row ", i, ": ", len(params[i])))
+		}
+		for _, v := range row {
+			err := checkPatchValue("", v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkPatchColumn(column string) error {
+	if !isParamName(column) {
+		return errors.New(fmt.Sprint("Invalid patch column: ", column))
+	}
+	if riPatchSystemColumns[strings.ToUpper(column)] {
+		return errors.New(fmt.Sprint("System column cannot be patched: ", column))
+	}
+	return nil
+}
+
+func checkPatchValue(column string, v interface{}) error {
+	if column != "" {
+		err := checkPatchColumn(column)
+		if err != nil {
+			return err
+		}
+	}
+	switch v.(type) {
+	case nil, string, bool, json.Number:
+		return nil
+	}
+	return errors.New(fmt.Sprint("Invalid patch value: ", column, ": ", v))
+}
+
+func (this *riPatch) apply(target *riPatchTarget) {
+	if target.Params != nil {
+		if this.Params != nil {
+			for _, row := range this.Params {
+				for j, v := range row {
+					row[j] = patchValue(v)
+				}
+			}
+			*target.Params = this.Params
+			if target.Data != nil {
+				target.Data["params"] = this.Params
+			}
+		}
+		return
+	}
+	for i, row := range target.Rows {
+		for _, k := range this.Unset {
+			delete(row, k)
+		}
+		for k, v := range this.Set {
+			row[k] = patchValue(v)
+		}
+		if this.Rows != nil {
+			for k, v := range this.Rows[i] {
+				row[k] = patchValue(v)
+			}
+		}
+	}
+}
+
+// patchValue passes numbers on as their exact text, so large ones keep
+// their precision, MySQL converts them as needed.
+func patchValue(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		return n.String()
+	}
+	return v
+}
@@ -0,0 +1,176 @@
+// ri_patch_test
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRiPatch(t *testing.T) {
+	var cases = []struct {
+		clientData string
+		none       bool
+		err        bool
+	}{
+		{"", true, false},
+		{"not json", true, false},
+		{`{"query_params":["x"]}`, true, false},
+		{`{"patch":null}`, true, false},
+		{`{"patch":{"set":{"NAME":"x"}}}`, false, false},
+		{`{"patch":{"params":[[1,"a"]]}}`, false, false},
+		{`{"patch":{"set":["NAME"]}}`, false, true},
+		{`{"patch":"set"}`, false, true},
+	}
+	for _, c := range cases {
+		patch, err := parseRiPatch(c.clientData)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseRiPatch(%q) expected an error", c.clientData)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRiPatch(%q) unexpected error: %v", c.clientData, err)
+			continue
+		}
+		if (patch == nil) != c.none {
+			t.Errorf("parseRiPatch(%q) got %v", c.clientData, patch)
+		}
+	}
+}
+
+func TestRiPatchValidate(t *testing.T) {
+	rows := func() *riPatchTarget {
+		return &riPatchTarget{Rows: []map[string]interface{}{{"NAME": "a"}, {"NAME": "b"}}}
+	}
+	params := func() *riPatchTarget {
+		p := [][]interface{}{{"a", "b"}}
+		return &riPatchTarget{Params: &p}
+	}
+	var cases = []struct {
+		patch  string
+		target *riPatchTarget
+		err    bool
+	}{
+		{`{"patch":{"set":{"NAME":"x","AGE":1,"ON":true,"NOTE":null}}}`, rows(), false},
+		{`{"patch":{"unset":["NOTE"]}}`, rows(), false},
+		{`{"patch":{"rows":[{"NAME":"x"},{"NAME":"y"}]}}`, rows(), false},
+		{`{"patch":{"params":[["x",2]]}}`, params(), false},
+		{`{"patch":{"set":{"NAME":"x"}}}`, nil, true},
+		{`{"patch":{"set":{"NAME":{"a":1}}}}`, rows(), true},
+		{`{"patch":{"set":{"NAME=1;--":"x"}}}`, rows(), true},
+		{`{"patch":{"set":{"ID":"x"}}}`, rows(), true},
+		{`{"patch":{"set":{"project_id":"x"}}}`, rows(), true},
+		{`{"patch":{"unset":["CREATOR_ID"]}}`, rows(), true},
+		{`{"patch":{"rows":[{"NAME":"x"},{"CREATE_TIME":"2000-01-01"}]}}`, rows(), true},
+		{`{"patch":{"rows":[{"NAME":"x"}]}}`, rows(), true},
+		{`{"patch":{"params":[["x"]]}}`, rows(), true},
+		{`{"patch":{"set":{"NAME":"x"}}}`, params(), true},
+		{`{"patch":{"params":[["x"]]}}`, params(), true},
+		{`{"patch":{"params":[["x",2],["y",3]]}}`, params(), true},
+		{`{"patch":{"params":[["x",[2]]]}}`, params(), true},
+	}
+	for _, c := range cases {
+		patch, err := parseRiPatch(c.patch)
+		if err != nil || patch == nil {
+			t.Errorf("parseRiPatch(%q) got %v, %v", c.patch, patch, err)
+			continue
+		}
+		err = patch.validate(c.target)
+		if c.err && err == nil {
+			t.Errorf("validate(%q) expected an error", c.patch)
+		}
+		if !c.err && err != nil {
+			t.Errorf("validate(%q) unexpected error: %v", c.patch, err)
+		}
+	}
+}
+
+func TestRiPatchApply(t *testing.T) {
+	patch, err := parseRiPatch(`{"patch":{"set":{"NAME":"x","AGE":12345678901234567890},"unset":["NOTE"],"rows":[{"RANK":1},{"RANK":2}]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &riPatchTarget{Rows: []map[string]interface{}{
+		{"NAME": "a", "NOTE": "n"},
+		{"NAME": "b"},
+	}}
+	patch.apply(target)
+	for i, row := range target.Rows {
+		if row["NAME"] != "x" || row["AGE"] != "12345678901234567890" || row["RANK"] != []string{"1", "2"}[i] {
+			t.Errorf("row %d got %v", i, row)
+		}
+		if _, ok := row["NOTE"]; ok {
+			t.Errorf("row %d NOTE not unset", i)
+		}
+	}
+
+	patch, err = parseRiPatch(`{"patch":{"params":[["x",2]]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := [][]interface{}{{"a", "b"}}
+	data := map[string]interface{}{"params": params}
+	patch.apply(&riPatchTarget{Params: &params, Data: data})
+	if params[0][0] != "x" || params[0][1] != "2" {
+		t.Errorf("params got %v", params)
+	}
+	if patched, _ := data["params"].([][]interface{}); len(patched) != 1 || patched[0][0] != "x" {
+		t.Errorf("data params got %v", data["params"])
+	}
+}
+
+func TestBeforeRemoteInterceptorPatch(t *testing.T) {
+	response := ""
+	received := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+	defaultEgress := egress
+	defer func() { egress = defaultEgress }()
+	egress, _ = parseEgressPolicy([]interface{}{"127.0.0.1", "::1"}, nil)
+
+	ri := map[string]string{"id": "ri1", "url": server.URL, "method": "POST", "failure_threshold": "0"}
+	intercept := func(rows []map[string]interface{}) (bool, error) {
+		return (&GlobalRemoteInterceptor{}).checkAgainstBeforeRemoteInterceptor(nil, nil, map[string]interface{}{},
+			`{"NAME":"a"}`, "p1", "t", "create", ri, &riPatchTarget{Rows: rows})
+	}
+
+	response = `{"patch":{"set":{"STATUS":"checked"},"unset":["NOTE"]}}`
+	rows := []map[string]interface{}{{"NAME": "a", "NOTE": "n"}}
+	ok, err := intercept(rows)
+	if !ok || err != nil {
+		t.Fatalf("got %v %v", ok, err)
+	}
+	if received != `{"NAME":"a"}` {
+		t.Errorf("interceptor received %q", received)
+	}
+	if rows[0]["STATUS"] != "checked" || rows[0]["NAME"] != "a" {
+		t.Errorf("got %v", rows[0])
+	}
+	if _, found := rows[0]["NOTE"]; found {
+		t.Errorf("NOTE not unset: %v", rows[0])
+	}
+
+	response = `{"patch":{"set":{"CREATOR_ID":"someone else"}}}`
+	rows = []map[string]interface{}{{"NAME": "a"}}
+	ok, err = intercept(rows)
+	if ok || err == nil {
+		t.Fatalf("a patch of a system column got %v %v", ok, err)
+	}
+	if len(rows[0]) != 1 {
+		t.Errorf("a rejected patch changed the row: %v", rows[0])
+	}
+
+	response = `ok`
+	rows = []map[string]interface{}{{"NAME": "a"}}
+	ok, err = intercept(rows)
+	if !ok || err != nil || len(rows[0]) != 1 {
+		t.Errorf("a response without a patch got %v %v %v", ok, err, rows[0])
+	}
+}
@@ -0,0 +1,113 @@
+// ri_signature
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqljson"
+	"github.com/satori/go.uuid"
+)
+
+// Every call to a remote interceptor carries these headers. The delivery
+// id is the id of the push notification for after-calls, so it stays the
+// same across retries and lets receivers drop duplicates, and a fresh one
+// for before-calls. The signature is
+//
+//	sha256=hex(HMAC-SHA256(secret, timestamp + "." + delivery + "." + body))
+//
+// with the SECRET of the remote interceptor; receivers should also reject
+// stale timestamps. Test fires also carry X-Netdata-Test: 1, and their
+// delivery id starts with test_, so the signature covers the marker and
+// receivers can tell them from real events.
+const (
+	riDeliveryHeader  = "X-Netdata-Delivery"
+	riTimestampHeader = "X-Netdata-Timestamp"
+	riSignatureHeader = "X-Netdata-Signature"
+	riTestHeader      = "X-Netdata-Test"
+
+	riTestDeliveryPrefix = "test_"
+)
+
+func generateRiSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newDeliveryId() string {
+	return strings.Replace(uuid.NewV4().String(), "-", "", -1)
+}
+
+func newTestDeliveryId() string {
+	return riTestDeliveryPrefix + newDeliveryId()
+}
+
+func riSignature(secret, timestamp, deliveryId, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + deliveryId + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRiRequest returns the delivery, timestamp and signature headers of a
+// call. Without a secret the call goes out unsigned.
+func signRiRequest(secret, deliveryId, body string) http.Header {
+	header := http.Header{}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(riDeliveryHeader, deliveryId)
+	header.Set(riTimestampHeader, timestamp)
+	if strings.HasPrefix(deliveryId, riTestDeliveryPrefix) {
+		header.Set(riTestHeader, "1")
+	}
+	if secret != "" {
+		header.Set(riSignatureHeader, riSignature(secret, timestamp, deliveryId, body))
+	}
+	return header
+}
+
+// ensureRiSecret generates the secret of a remote interceptor that was
+// created before there were secrets.
+func ensureRiSecret(db *sql.DB, riMap map[string]string) error {
+	if riMap["SECRET"] != "" {
+		return nil
+	}
+	secret, err := generateRiSecret()
+	if err != nil {
+		return err
+	}
+	_, err = gosqljson.ExecDb(db, `UPDATE remote_interceptor SET SECRET=? WHERE ID=? AND (SECRET IS NULL OR SECRET='')`,
+		secret, riMap["ID"])
+	if err != nil {
+		return err
+	}
+	riMap["SECRET"] = secret
+	return nil
+}
+
+// loadRemoteInterceptorById loads the remote interceptor that queued a push
+// notification with lower case field names, as it is cached, so the
+// notification is sent with its current secret and options. It is empty
+// when the interceptor is gone or unknown.
+func loadRemoteInterceptorById(db *sql.DB, riId string) (map[string]string, error) {
+	if riId == "" {
+		return map[string]string{}, nil
+	}
+	data, err := gosqljson.QueryDbToMap(db, "lower", `SELECT * FROM remote_interceptor WHERE ID=?`, riId)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return map[string]string{}, nil
+	}
+	return data[0], nil
+}